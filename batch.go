@@ -0,0 +1,144 @@
+package gonami
+
+import (
+	"net"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// batchConn moves several datagrams per syscall. on linux this maps
+// onto sendmmsg/recvmmsg, elsewhere x/net falls back to one datagram
+// per call, so callers don't need to care
+type batchConn interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+func newBatchConn(conn net.PacketConn) batchConn {
+	udpConn, ok := conn.(*net.UDPConn)
+	if !ok {
+		//not a system socket, see Network
+		return packetBatchConn{conn}
+	}
+	if addr, ok := udpConn.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil && addr.IP != nil {
+		return ipv6.NewPacketConn(udpConn)
+	}
+	return ipv4.NewPacketConn(udpConn)
+}
+
+// packetBatchConn moves a datagram per call, for any net.PacketConn
+type packetBatchConn struct {
+	conn net.PacketConn
+}
+
+func (c packetBatchConn) ReadBatch(ms []ipv4.Message, flags int) (int, error) {
+	n, addr, err := c.conn.ReadFrom(ms[0].Buffers[0])
+	if err != nil {
+		return 0, err
+	}
+	ms[0].N = n
+	ms[0].Addr = addr
+	return 1, nil
+}
+
+func (c packetBatchConn) WriteBatch(ms []ipv4.Message, flags int) (int, error) {
+	if _, err := c.conn.WriteTo(ms[0].Buffers[0], ms[0].Addr); err != nil {
+		return 0, err
+	}
+	return 1, nil
+}
+
+func newMessages(n int, bufSize int) []ipv4.Message {
+	msgs := make([]ipv4.Message, n)
+	for i := range msgs {
+		msgs[i].Buffers = [][]byte{make([]byte, bufSize)}
+	}
+	return msgs
+}
+
+// batchReader hands out datagrams one at a time, but reads them from
+// the socket a batch at a time
+type batchReader struct {
+	bc   batchConn
+	msgs []ipv4.Message
+	n    int
+	next int
+}
+
+func newBatchReader(conn net.PacketConn, batchSize int, bufSize int) *batchReader {
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	return &batchReader{bc: newBatchConn(conn), msgs: newMessages(batchSize, bufSize)}
+}
+
+// read returns the next datagram. the returned slice is only valid
+// until the next call to read
+func (r *batchReader) read() ([]byte, error) {
+	if r.next >= r.n {
+		n, err := r.bc.ReadBatch(r.msgs, 0)
+		if err != nil {
+			return nil, err
+		}
+		r.n = n
+		r.next = 0
+	}
+	msg := r.msgs[r.next]
+	r.next++
+	return msg.Buffers[0][:msg.N], nil
+}
+
+// from is where the datagram last returned by read came from
+func (r *batchReader) from() net.Addr {
+	return r.msgs[r.next-1].Addr
+}
+
+// batchWriter queues up encoded packets and writes them out in as few
+// syscalls as possible
+type batchWriter struct {
+	bc   batchConn
+	addr net.Addr
+	msgs []ipv4.Message
+	bufs [][]byte
+	n    int
+}
+
+// newBatchWriter creates a writer for conn, sending to addr
+func newBatchWriter(conn net.PacketConn, addr net.Addr, batchSize int) *batchWriter {
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	return &batchWriter{bc: newBatchConn(conn), addr: addr, msgs: make([]ipv4.Message, batchSize), bufs: make([][]byte, batchSize)}
+}
+
+func (w *batchWriter) full() bool {
+	return w.n == len(w.msgs)
+}
+
+// buf returns the emptied buffer for the next packet, so that
+// encoding can reuse the memory of earlier batches
+func (w *batchWriter) buf() []byte {
+	return w.bufs[w.n][:0]
+}
+
+// add queues b, which should have been built on top of buf
+func (w *batchWriter) add(b []byte) {
+	w.bufs[w.n] = b
+	w.msgs[w.n].Buffers = w.bufs[w.n : w.n+1]
+	w.msgs[w.n].Addr = w.addr
+	w.n++
+}
+
+func (w *batchWriter) flush() error {
+	sent := 0
+	defer func() { w.n = 0 }()
+	for sent < w.n {
+		n, err := w.bc.WriteBatch(w.msgs[sent:w.n], 0)
+		if err != nil {
+			return err
+		}
+		sent += n
+	}
+	return nil
+}
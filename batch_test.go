@@ -0,0 +1,58 @@
+package gonami
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// benchmarkLoopback sends packets datagrams over loopback and reads
+// them back, batchSize at a time
+func benchmarkLoopback(b *testing.B, batchSize int) {
+	const (
+		packets    = 64
+		packetSize = 1400
+	)
+	rx, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer rx.Close()
+	tx, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer tx.Close()
+
+	w := newBatchWriter(tx, rx.LocalAddr(), batchSize)
+	r := newBatchReader(rx, batchSize, packetSize)
+	payload := make([]byte, packetSize)
+	b.SetBytes(packets * packetSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for sent := 0; sent < packets; sent++ {
+			w.add(append(w.buf(), payload...))
+			if w.full() || sent == packets-1 {
+				if err := w.flush(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+		//what went out all fits in the socket buffer, so nothing is lost
+		rx.SetReadDeadline(time.Now().Add(time.Second))
+		for received := 0; received < packets; received++ {
+			if _, err := r.read(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkLoopback(b *testing.B) {
+	for _, batchSize := range []int{1, 8, 32} {
+		b.Run("batch="+strconv.Itoa(batchSize), func(b *testing.B) {
+			benchmarkLoopback(b, batchSize)
+		})
+	}
+}
@@ -1,12 +1,17 @@
 package gonami
 
 import (
+	"encoding/binary"
+	"errors"
+	"math"
 	"reflect"
 	"strings"
 
 	"gopkg.in/mgo.v2/bson"
 )
 
+var errCorruptBson = errors.New("Corrupt bson document")
+
 //a bit hacked together, but seems to be better than the default
 //gobencoder
 
@@ -43,17 +48,217 @@ func (b BsonEncoder) Decode(data []byte, numBytes int) (*Packet, error) {
 		if payload, ok := msg.Payload.(bson.M); ok {
 			b := Retransmit{}
 			fillStruct(payload, &b)
-			pBlockNums := payload["blocknums"].([]interface{})
-			blockNums := make([]int, len(pBlockNums))
-			for i, block := range pBlockNums {
-				blockNums[i] = block.(int)
-			}
-			b.BlockNums = blockNums
 			msg.Payload = b
 		}
+	case DATA_PORTS:
+		if payload, ok := msg.Payload.(bson.M); ok {
+			p := DataPorts{}
+			fillStruct(payload, &p)
+			msg.Payload = p
+		}
+	case ERROR_RATES:
+		if payload, ok := msg.Payload.(bson.M); ok {
+			r := PathErrorRates{}
+			fillStruct(payload, &r)
+			msg.Payload = r
+		}
+	case PATH_PARAMS:
+		if payload, ok := msg.Payload.(bson.M); ok {
+			p := PathParams{}
+			fillStruct(payload, &p)
+			msg.Payload = p
+		}
+	case FILE_IDENTITY:
+		if payload, ok := msg.Payload.(bson.M); ok {
+			id := FileIdentity{}
+			fillStruct(payload, &id)
+			msg.Payload = id
+		}
+	case PATH_CHALLENGE:
+		if payload, ok := msg.Payload.(bson.M); ok {
+			c := PathChallenge{}
+			fillStruct(payload, &c)
+			msg.Payload = c
+		}
 	}
 	return &msg, nil
 }
+
+// AppendBlock encodes a DATA packet carrying block onto buf. the bytes
+// are the same as what Encode produces, just without the reflection
+func (b BsonEncoder) AppendBlock(buf []byte, block *Block) ([]byte, error) {
+	start := len(buf)
+	buf = append(buf, 0, 0, 0, 0)
+	buf = appendBsonInt(buf, "type", int64(DATA))
+	buf = appendBsonName(buf, 0x03, "payload")
+	payloadStart := len(buf)
+	buf = append(buf, 0, 0, 0, 0)
+	buf = appendBsonInt(buf, "number", int64(block.Number))
+	buf = appendBsonName(buf, 0x05, "data")
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(block.Data)))
+	buf = append(buf, 0x00)
+	buf = append(buf, block.Data...)
+	buf = appendBsonInt(buf, "type", int64(block.Type))
+	//omitempty, like mgo
+	if block.Shard != 0 {
+		buf = appendBsonInt(buf, "shard", int64(block.Shard))
+	}
+	if block.Parity != 0 {
+		buf = appendBsonInt(buf, "parity", int64(block.Parity))
+	}
+	if block.Compressed {
+		buf = appendBsonName(buf, 0x08, "compressed")
+		buf = append(buf, 1)
+	}
+	if block.Seq != 0 {
+		buf = appendBsonInt(buf, "seq", int64(block.Seq))
+	}
+	buf = append(buf, 0)
+	binary.LittleEndian.PutUint32(buf[payloadStart:], uint32(len(buf)-payloadStart))
+	buf = append(buf, 0)
+	binary.LittleEndian.PutUint32(buf[start:], uint32(len(buf)-start))
+	return buf, nil
+}
+
+// DecodeBlock decodes a DATA packet into block. block.Data points into
+// data, so it is only valid for as long as data is
+func (b BsonEncoder) DecodeBlock(data []byte, block *Block) error {
+	var payload []byte
+	err := walkBsonDoc(data, func(kind byte, name []byte, value []byte) error {
+		switch string(name) {
+		case "type":
+			if t, ok := bsonInt(kind, value); !ok || t != int64(DATA) {
+				return errors.New("Expecting DATA, did not receive it")
+			}
+		case "payload":
+			if kind != 0x03 {
+				return errors.New("Incorrect payload type")
+			}
+			payload = value
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if payload == nil {
+		return errors.New("Incorrect payload type")
+	}
+	*block = Block{}
+	return walkBsonDoc(payload, func(kind byte, name []byte, value []byte) error {
+		switch string(name) {
+		case "number":
+			n, _ := bsonInt(kind, value)
+			block.Number = int(n)
+		case "type":
+			t, _ := bsonInt(kind, value)
+			block.Type = BlockType(t)
+		case "shard":
+			n, _ := bsonInt(kind, value)
+			block.Shard = int(n)
+		case "parity":
+			n, _ := bsonInt(kind, value)
+			block.Parity = int(n)
+		case "seq":
+			n, _ := bsonInt(kind, value)
+			block.Seq = int(n)
+		case "compressed":
+			block.Compressed = kind == 0x08 && len(value) > 0 && value[0] != 0
+		case "data":
+			if kind != 0x05 || len(value) < 5 {
+				return errors.New("Incorrect block data")
+			}
+			block.Data = value[5:]
+		}
+		return nil
+	})
+}
+
+func appendBsonName(buf []byte, kind byte, name string) []byte {
+	buf = append(buf, kind)
+	buf = append(buf, name...)
+	return append(buf, 0)
+}
+
+// appendBsonInt follows mgo in using an int32 whenever the value fits
+func appendBsonInt(buf []byte, name string, i int64) []byte {
+	if i >= math.MinInt32 && i <= math.MaxInt32 {
+		buf = appendBsonName(buf, 0x10, name)
+		return binary.LittleEndian.AppendUint32(buf, uint32(int32(i)))
+	}
+	buf = appendBsonName(buf, 0x12, name)
+	return binary.LittleEndian.AppendUint64(buf, uint64(i))
+}
+
+func bsonInt(kind byte, value []byte) (int64, bool) {
+	switch kind {
+	case 0x10:
+		return int64(int32(binary.LittleEndian.Uint32(value))), true
+	case 0x12:
+		return int64(binary.LittleEndian.Uint64(value)), true
+	}
+	return 0, false
+}
+
+// walkBsonDoc calls fn for every element of doc, with the raw bytes of
+// the element's value. only the element kinds gonami produces are understood
+func walkBsonDoc(doc []byte, fn func(kind byte, name []byte, value []byte) error) error {
+	if len(doc) < 5 {
+		return errCorruptBson
+	}
+	l := int(binary.LittleEndian.Uint32(doc))
+	if l > len(doc) || l < 5 {
+		return errCorruptBson
+	}
+	doc = doc[4 : l-1]
+	for len(doc) > 0 {
+		kind := doc[0]
+		end := 1
+		for end < len(doc) && doc[end] != 0 {
+			end++
+		}
+		if end == len(doc) {
+			return errCorruptBson
+		}
+		name := doc[1:end]
+		doc = doc[end+1:]
+		var size int
+		switch kind {
+		case 0x01, 0x12: //double, int64
+			size = 8
+		case 0x10: //int32
+			size = 4
+		case 0x08: //bool
+			size = 1
+		case 0x0A: //null
+			size = 0
+		case 0x02, 0x05: //string, binary
+			if len(doc) < 4 {
+				return errCorruptBson
+			}
+			size = 4 + int(binary.LittleEndian.Uint32(doc))
+			if kind == 0x05 {
+				size++
+			}
+		case 0x03, 0x04: //document, array
+			if len(doc) < 4 {
+				return errCorruptBson
+			}
+			size = int(binary.LittleEndian.Uint32(doc))
+		default:
+			return errCorruptBson
+		}
+		if size < 0 || size > len(doc) {
+			return errCorruptBson
+		}
+		if err := fn(kind, name, doc[:size]); err != nil {
+			return err
+		}
+		doc = doc[size:]
+	}
+	return nil
+}
+
 func fillStruct(data map[string]interface{}, result interface{}) {
 	t := reflect.ValueOf(result).Elem()
 	typeOfT := t.Type()
@@ -61,15 +266,30 @@ func fillStruct(data map[string]interface{}, result interface{}) {
 		fieldName := typeOfT.Field(i).Name
 		v := strings.ToLower(fieldName)
 		if mVal, ok := data[v]; ok {
-			sVal := t.FieldByName(fieldName)
-			if fieldName == "Type" {
-				sVal.SetInt(int64(reflect.ValueOf(mVal).Interface().(int)))
-			} else if fieldName == "BlockNums" {
-				continue
-			} else {
-				sVal.Set(reflect.ValueOf(mVal))
-			}
+			setConverted(t.FieldByName(fieldName), reflect.ValueOf(mVal))
+		}
+	}
+}
 
+// setConverted sets field to val, converting from the types bson
+// decodes into, eg int to BlockType or []interface{} to []int
+func setConverted(field reflect.Value, val reflect.Value) {
+	if val.Kind() == reflect.Interface {
+		val = val.Elem()
+	}
+	if !val.IsValid() {
+		return
+	}
+	switch {
+	case val.Type().AssignableTo(field.Type()):
+		field.Set(val)
+	case field.Kind() == reflect.Slice && val.Kind() == reflect.Slice:
+		s := reflect.MakeSlice(field.Type(), val.Len(), val.Len())
+		for i := 0; i < val.Len(); i++ {
+			setConverted(s.Index(i), val.Index(i))
 		}
+		field.Set(s)
+	case val.Type().ConvertibleTo(field.Type()):
+		field.Set(val.Convert(field.Type()))
 	}
 }
@@ -0,0 +1,33 @@
+package gonami
+
+// bufferPool is a fixed size free list of equally sized buffers. unlike
+// sync.Pool, handing buffers back and forth never allocates
+type bufferPool struct {
+	size int
+	free chan []byte
+}
+
+func newBufferPool(size int, n int) *bufferPool {
+	return &bufferPool{size: size, free: make(chan []byte, n)}
+}
+
+func (p *bufferPool) get() []byte {
+	select {
+	case b := <-p.free:
+		return b
+	default:
+		return make([]byte, p.size)
+	}
+}
+
+// put hands b back to the pool. buffers that are too small, or that
+// don't fit in the free list are left to the garbage collector
+func (p *bufferPool) put(b []byte) {
+	if cap(b) < p.size {
+		return
+	}
+	select {
+	case p.free <- b[:p.size]:
+	default:
+	}
+}
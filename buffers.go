@@ -0,0 +1,70 @@
+package gonami
+
+import (
+	"log"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	minSocketBuffer = 1 << 20
+	maxSocketBuffer = 256 << 20
+	//how long the receiver can fall behind without the buffer overflowing
+	bufferSlack = 20 * time.Millisecond
+)
+
+// socketBufferSize sizes the kernel buffer of a data socket carrying
+// byteRate bytes a second. it holds two round trips worth, so the rate
+// can grow before the client has reported back, and enough on top to
+// ride out the reader being held up for a moment
+func socketBufferSize(byteRate float64, rtt time.Duration) int {
+	size := byteRate * (2*rtt + bufferSlack).Seconds()
+	if size < minSocketBuffer {
+		return minSocketBuffer
+	}
+	if size > maxSocketBuffer {
+		return maxSocketBuffer
+	}
+	return int(size)
+}
+
+// tuneSocketBuffers sets the receive or send buffers of conns to size,
+// and returns a warning if the kernel gave any of them less
+func tuneSocketBuffers(conns []net.PacketConn, size int, receive bool) string {
+	kind := "Send"
+	if receive {
+		kind = "Receive"
+	}
+	clamped := size
+	for _, c := range conns {
+		//only the system's sockets have buffers to set, see Network
+		conn, ok := c.(interface {
+			SetReadBuffer(bytes int) error
+			SetWriteBuffer(bytes int) error
+		})
+		if !ok {
+			continue
+		}
+		var err error
+		if receive {
+			err = conn.SetReadBuffer(size)
+		} else {
+			err = conn.SetWriteBuffer(size)
+		}
+		if err != nil {
+			log.Println("Error setting socket buffer: " + err.Error())
+			continue
+		}
+		//not every platform can tell us what we got
+		actual, err := socketBuffer(c, receive)
+		if err == nil && actual < clamped {
+			clamped = actual
+		}
+	}
+	if clamped >= size {
+		return ""
+	}
+	return kind + " buffers limited to " + strconv.Itoa(clamped) + " bytes of the " + strconv.Itoa(size) +
+		" asked for, raise the system's limit to avoid losing data at high rates"
+}
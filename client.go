@@ -1,23 +1,50 @@
 package gonami
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"log"
 	"net"
 	"path/filepath"
+	"time"
 )
 
 type Client struct {
-	encoder        Encoder
-	config         Config
-	localDirectory string
+	encoder         Encoder
+	config          Config
+	localDirectory  string
+	Proxy           string      //socks5:// or socks5h:// URL of a proxy to reach the server through, the data comes over TCP if it can't relay UDP
+	QUIC            bool        //connect over QUIC instead of TCP, which the server has to take as well. can't go through Proxy
+	TLSConfig       *tls.Config //to verify the server's certificate for QUIC, which needs it or QUICFingerprint
+	QUICFingerprint string      //hex SHA-256 of the server's certificate for QUIC, eg the self signed one a server logs
+	Network         Network     //opens the connections and sockets, the system's network when nil
+	ServerDirectory string      //where this host sees the server's directory, eg a shared volume. when set, the file is copied from there if it is the one the server has
 }
 
 type clientTransfer struct {
-	fn         string
-	c          Config
-	progressCh chan Progress
-	filesize   int64
-	ld         string
+	fn       string
+	c        Config
+	progress *progressRelay
+	filesize int64
+	ld       string
+	rtt      *rttEstimator
+	//control messages for the download, eg END_OF_PASS
+	controlCh chan controlMsg
+	//closed when the server gives up on the transfer
+	aborted   chan bool
+	transport TransportType
+	//the server's file was copied straight from serverDir
+	local     bool
+	serverDir string
+	//blocks for the download when they come over TCP
+	tcp *tcpReceiver
+	//the server as we were asked for it, and the proxy in the way
+	serverHost   string
+	proxy        *socksProxy
+	associations []*socksAssociation
+	//what the connections and sockets are opened on
+	network Network
 }
 
 func (ct *clientTransfer) config() Config {
@@ -25,7 +52,9 @@ func (ct *clientTransfer) config() Config {
 }
 
 func (ct *clientTransfer) updateProgress(progress Progress) {
-	ct.progressCh <- progress
+	progress.Transport = ct.transport
+	progress.Local = ct.local
+	ct.progress.update(progress)
 }
 
 func (ct *clientTransfer) filename() string {
@@ -41,7 +70,9 @@ func (ct *clientTransfer) fullPath() string {
 }
 
 func newClientTransfer(filename string, localDirectory string, c Config, progressCh chan Progress) *clientTransfer {
-	return &clientTransfer{fn: filename, ld: localDirectory, c: c, progressCh: progressCh}
+	relay := newProgressRelay(progressCh, time.Duration(c.ProgressInterval)*time.Millisecond)
+	return &clientTransfer{fn: filename, ld: localDirectory, c: c, progress: relay, rtt: &rttEstimator{},
+		controlCh: make(chan controlMsg, 1), aborted: make(chan bool)}
 }
 
 func NewClient(localDirectory string, config Config, encoder Encoder) *Client {
@@ -50,25 +81,64 @@ func NewClient(localDirectory string, config Config, encoder Encoder) *Client {
 
 func (c *Client) GetFile(filename string, serverAddr string) <-chan Progress {
 	ch := make(chan Progress)
-	go getFile(filename, c.localDirectory, serverAddr, c.encoder, c.config, ch)
+	go getFile(filename, serverAddr, c, ch)
 	return ch
 }
 
-func getFile(filename string, localDirectory string, serverAddr string, e Encoder, config Config, ch chan Progress) {
-	defer close(ch)
-	conn, err := net.Dial("tcp", serverAddr)
+func getFile(filename string, serverAddr string, cl *Client, ch chan Progress) {
+	config := cl.config
+	e := cl.encoder
+	ct := newClientTransfer(filename, cl.localDirectory, config, ch)
+	defer ct.progress.close()
+	ct.network = orSystem(cl.Network)
+	//the server only needs to know to say which file it has
+	ct.serverDir = cl.ServerDirectory
+	ct.c.OfferIdentity = cl.ServerDirectory != ""
+	ct.serverHost, _, _ = net.SplitHostPort(serverAddr)
+	var conn net.Conn
+	var err error
+	if cl.QUIC && cl.Proxy != "" {
+		err = errors.New("QUIC can't go through the proxy")
+	} else if cl.QUIC {
+		conn, err = dialQUIC(ct.network, serverAddr, cl.TLSConfig, cl.QUICFingerprint, config.ControlDSCP)
+	} else if cl.Proxy != "" {
+		ct.proxy, err = parseProxyURL(cl.Proxy, ct.network)
+		if err == nil {
+			//the relay only lets the data in once we have sent something
+			//out through it, the same as a NAT
+			ct.c.Passive = true
+			ct.c.Multipath = false
+			conn, err = ct.proxy.dial(serverAddr)
+		}
+		defer func() {
+			for _, a := range ct.associations {
+				a.close()
+			}
+		}()
+	} else {
+		conn, err = ct.network.DialContext(context.Background(), "tcp", serverAddr)
+	}
 	if err != nil {
 		errMsg := "Error establishing connection: " + err.Error()
 		log.Println(errMsg)
-		ch <- Progress{Type: ERROR, Message: errMsg, Percentage: 0}
+		ct.updateProgress(Progress{Type: ERROR, Message: errMsg, Percentage: 0})
 		return
 	}
 	defer conn.Close()
+	//QUIC marks its socket when dialing
+	if config.ControlDSCP != 0 && !cl.QUIC {
+		if err := setDSCP(conn, remoteIP(conn), config.ControlDSCP); err != nil {
+			log.Println("Error marking control connection: " + err.Error())
+		}
+	}
 	//start everything off with sending our version number
 	pkt := Packet{Type: REV, Payload: revision}
-	ch <- Progress{Type: HANDSHAKING, Message: "Sending client version", Percentage: 0}
-	b, _ := e.Encode(&pkt)
-	conn.Write(b)
-	ct := newClientTransfer(filename, localDirectory, config, ch)
-	readPackets(conn, e, ct, onVersionConfirmedState)
+	ct.updateProgress(Progress{Type: HANDSHAKING, Message: "Sending client version", Percentage: 0})
+	sent := time.Now()
+	sendPacket(&pkt, conn, e)
+	//the reply gives a first measure of the round trip time
+	onVersionConfirmedStateWrapper := func(pkt1 *Packet, e1 Encoder, conn1 net.Conn, t1 transfer) stateFn {
+		return onVersionConfirmedState(pkt1, e1, conn1, t1, sent)
+	}
+	readPackets(conn, e, ct, onVersionConfirmedStateWrapper)
 }
@@ -5,42 +5,71 @@ import (
 	"math"
 	"net"
 	"os"
-	"sort"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/willf/bitset"
 )
 
+// defaults, used until the round trip time has been measured
 const (
 	retransmitIteration = 50
 	retransmitTimeDelta = 320 * time.Millisecond
 	readTimeout         = 2 * time.Second
 )
 
-func handleDownload(e Encoder, controlConn net.Conn, dataConn *net.UDPConn, t *clientTransfer) {
+func handleDownload(e Encoder, controlConn net.Conn, dataConns []net.PacketConn, t *clientTransfer) {
 	var wg sync.WaitGroup
 
 	numBlocks := int(math.Ceil(float64(t.filesize) / float64(t.config().BlockSize)))
 
 	bs := bitset.New(uint(numBlocks))
-	defer dataConn.Close()
+	defer closeConns(dataConns)
 	fo, err := os.Create(t.fullPath())
-	defer fo.Close()
 	if err != nil {
-		errMsg := "Error opening file: " + err.Error()
-		log.Println(errMsg)
-		t.updateProgress(Progress{Type: ERROR, Message: errMsg, Percentage: 0})
+		abortTransfer("Error opening file: "+err.Error(), controlConn, e, t)
+		//ends readPackets, and with it the transfer
+		controlConn.Close()
+		return
+	}
+	defer fo.Close()
+	//received data is copied out of the socket buffers into pooled
+	//buffers, which the writer hands back once they are buffered up
+	blockPool := newBufferPool(t.config().BlockSize, len(dataConns)*(t.config().ReceiveQueueLength+2*t.config().BatchSize))
+	if t.tcp != nil {
+		blockPool = t.tcp.pool
+	}
+	fileWriter := make(chan Block, t.config().BatchSize)
+	writerClosed := false
+	closeWriter := func() {
+		if !writerClosed {
+			writerClosed = true
+			close(fileWriter)
+			wg.Wait()
+		}
 	}
-	fileWriter := make(chan Block)
-	defer close(fileWriter)
+	defer closeWriter()
 
-	//handles writing the blocks to the file
+	//handles writing the blocks to the file, coalesced into extents
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		for block := range fileWriter {
-			writeData(block.Data, block.Number*t.config().BlockSize, fo)
+		ew := newExtentWriter(fo, t.filesize, t.config())
+		idleCheck := time.NewTicker(ew.timeout / 2)
+		defer idleCheck.Stop()
+		for {
+			select {
+			case block, ok := <-fileWriter:
+				if !ok {
+					ew.flushAll()
+					return
+				}
+				ew.write(block)
+				blockPool.put(block.Data)
+			case <-idleCheck.C:
+				ew.flushIdle()
+			}
 		}
 	}()
 
@@ -50,139 +79,239 @@ func handleDownload(e Encoder, controlConn net.Conn, dataConn *net.UDPConn, t *c
 	receivedBlocks := 0
 
 	lastRetransmitTime := time.Now()
-	var retransmitBlocks []int
+	var retransmitBlocks rangeList
+	passEnded := false
+	//fires once blocks sent before the end of the pass have had time to
+	//come through, see rttEstimator.tailHoldback
+	var tailTimer <-chan time.Time
+	endOfPass := 0
+	//blocks striped across several streams can overtake each other
+	window := reorderWindow(t.config())
+	var pendingBlocks []Block
+	//for the throughput, before and after decompression
+	start := time.Now()
+	var fileBytes, wireBytes int64
+	var fec *fecDecoder
+	if t.config().FECDataShards > 0 {
+		fec = newFECDecoder(t.config(), t.filesize, numBlocks)
+	}
 
-	buf := make([]byte, t.config().BlockSize+500)
-	dataConn.SetReadDeadline(time.Now().Add(readTimeout))
+	done := make(chan bool)
+	defer close(done)
+	var decoded <-chan decodedBlock
+	var streams []*streamStats
+	if t.tcp != nil {
+		decoded = t.tcp.blocks
+		defer t.tcp.stop()
+	} else {
+		var relays []*net.UDPAddr
+		for _, a := range t.associations {
+			relays = append(relays, a.relay)
+		}
+		decoded, streams = startReceivePipeline(e, dataConns, relays, t.config(), blockPool, done)
+	}
+	streamSamples := make([]streamSample, len(streams))
+	go sendPings(controlConn, e, done)
+	readTimer := time.NewTimer(t.rtt.readTimeout())
+	defer readTimer.Stop()
 
 	for {
-		n, _, err := dataConn.ReadFromUDP(buf)
-		dataConn.SetReadDeadline(time.Now().Add(readTimeout))
-		if err != nil {
-			if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
-				//we timedout on a read, but don't have all the data
-				//so send a retransmit and try again
-				restart := false
-				if len(retransmitBlocks) <= 0 {
-					retransmitBlocks = insertRetransmitBlock(retransmitBlocks, gaplessToBlock+1)
-					restart = true
-				}
-				requestRetransmit(retransmitBlocks, bs, controlConn, e, restart)
-				retransmitBlocks = []int{}
-				dataConn.SetReadDeadline(time.Now().Add(readTimeout))
-				continue
-			} else {
-				log.Println("Error reading from socket: " + err.Error())
+		var d decodedBlock
+		select {
+		case received, ok := <-decoded:
+			if !ok {
 				return
 			}
-
-		}
-		pkt, err := e.Decode(buf, n)
-		if err != nil {
-			log.Println(err)
+			d = received
+			resetTimer(readTimer, t.rtt.readTimeout())
+		case <-readTimer.C:
+			//we timedout on a read, but don't have all the data
+			//so send a retransmit and try again. nothing goes
+			//missing over TCP, it is just slow
+			if t.tcp != nil {
+				resetTimer(readTimer, t.rtt.readTimeout())
+				continue
+			}
+			if passEnded {
+				//we know exactly what is missing, so just ask for it
+				requestMissing(numBlocks-1, bs, controlConn, e, t.config())
+				retransmitBlocks = nil
+				resetTimer(readTimer, t.rtt.readTimeout())
+				continue
+			}
+			restart := false
+			if len(retransmitBlocks) <= 0 {
+				retransmitBlocks = retransmitBlocks.insert(gaplessToBlock+1, gaplessToBlock+2)
+				restart = true
+			}
+			requestRetransmit(retransmitBlocks, bs, controlConn, e, restart)
+			retransmitBlocks = nil
+			resetTimer(readTimer, t.rtt.readTimeout())
+			continue
+		case msg := <-t.controlCh:
+			//nothing goes missing over TCP, the blocks not counted yet
+			//are just still buffered
+			if msg.msgType == END_OF_PASS && t.tcp == nil {
+				//the server has sent everything once, but the tail of
+				//it may still be in the socket buffers or the pipeline
+				passEnded = true
+				endOfPass = msg.payload.(int)
+				tailTimer = time.After(t.rtt.tailHoldback())
+			}
+			continue
+		case <-t.aborted:
 			return
-		}
-		//write the block to file and build out the list of blocks
-		//to retransmit
-		block := pkt.Payload.(Block)
-		//send the block to be written
-		fileWriter <- block
-		bs.Set(uint(block.Number))
-		receivedBlocks++
-		if block.Number > expectedBlock {
-			if (len(retransmitBlocks) + (block.Number - expectedBlock)) > t.config().MaxMissedLength {
-				requestRetransmit(retransmitBlocks, bs, controlConn, e, true)
-				retransmitBlocks = []int{}
-			} else {
-				for i := expectedBlock; i < block.Number; i++ {
-					retransmitBlocks = insertRetransmitBlock(retransmitBlocks, i)
-				}
+		case <-tailTimer:
+			if len(decoded) > 0 {
+				//count what has already come in first
+				tailTimer = time.After(minRetransmitInterval)
+				continue
 			}
-			missedBlocks = missedBlocks + (block.Number - expectedBlock)
+			tailTimer = nil
+			//whatever we haven't got by now is lost. the parity for the
+			//last group may still be on its way, the read timeout picks
+			//up anything it can't rebuild
+			requestMissing(retransmitHoldback(endOfPass+1, t.config())-1, bs, controlConn, e, t.config())
+			retransmitBlocks = nil
+			lastRetransmitTime = time.Now()
+			continue
 		}
-		//if we have received all the blocks, we are done!
-		if int(bs.Count()) == numBlocks {
-			pkt := Packet{Type: DONE}
-			data, _ := e.Encode(&pkt)
-			controlConn.Write(data)
-			t.updateProgress(Progress{Type: TRANSFERRING, Message: "Finalizing file", Percentage: 1})
-			wg.Wait()
+		if d.err != nil {
+			log.Println("Error receiving block: " + d.err.Error())
 			return
 		}
-		//we will be expecting the next block number
-		//in case of restart: these resent blocks are labeled original as well
-		if block.Type == ORIGINAL {
-			expectedBlock = block.Number + 1
+		//a stray or forged datagram could name any block
+		if d.block.Type != PARITY && (d.block.Number < 0 || d.block.Number >= numBlocks) {
+			log.Println("Dropping block outside the file: " + strconv.Itoa(d.block.Number))
+			blockPool.put(d.block.Data)
+			continue
 		}
-		//keeps track of the point up to where we have received all the blocks
-		//with no missing blocks in between
-		for bs.Test(uint(gaplessToBlock+1)) && gaplessToBlock < numBlocks {
-			gaplessToBlock++
+		wireBytes += int64(d.wireSize)
+		//parity blocks aren't written out, but may let us rebuild the
+		//blocks their group lost
+		pendingBlocks = append(pendingBlocks[:0], d.block)
+		if d.block.Type == PARITY {
+			pendingBlocks = pendingBlocks[:0]
+			if fec != nil {
+				pendingBlocks = fec.addParity(d.block, bs, blockPool, pendingBlocks)
+			}
+			blockPool.put(d.block.Data)
+		} else if fec != nil {
+			fec.addData(d.block)
 		}
-		//if we meet our retransmit criteria, send message to server
-		if shouldRetransmit(bs.Count(), lastRetransmitTime) {
-			//send the error rate
-			sendErrorRate(receivedBlocks, missedBlocks, controlConn, e)
-			//request the retransmit
-			requestRetransmit(retransmitBlocks, bs, controlConn, e, false)
-			retransmitBlocks = []int{}
-			lastRetransmitTime = time.Now()
-			missedBlocks = 0
-			receivedBlocks = 0
+		for _, block := range pendingBlocks {
+			//write the block to file and build out the list of blocks
+			//to retransmit
+			fileBytes += int64(len(block.Data))
+			fileWriter <- block
+			late := block.Type == ORIGINAL && block.Number < expectedBlock && expectedBlock-block.Number <= window
+			if late && !bs.Test(uint(block.Number)) && missedBlocks > 0 {
+				//counted as missed when the blocks around it overtook it
+				missedBlocks--
+			}
+			bs.Set(uint(block.Number))
+			receivedBlocks++
+			if block.Number > expectedBlock {
+				if len(retransmitBlocks)+1 > t.config().MaxMissedLength {
+					requestRetransmit(retransmitBlocks, bs, controlConn, e, true)
+					retransmitBlocks = nil
+				} else {
+					retransmitBlocks = retransmitBlocks.insert(expectedBlock, block.Number)
+				}
+				missedBlocks = missedBlocks + (block.Number - expectedBlock)
+			}
+			//if we have received all the blocks, we are done!
+			if int(bs.Count()) == numBlocks {
+				t.updateProgress(Progress{Type: TRANSFERRING, Message: "Finalizing file", Percentage: 1})
+				//make sure everything is on disk before telling the server
+				closeWriter()
+				pkt := Packet{Type: DONE}
+				sendPacket(&pkt, controlConn, e)
+				return
+			}
+			//we will be expecting the next block number
+			//in case of restart: these resent blocks are labeled original as well
+			if block.Type == ORIGINAL && !late {
+				expectedBlock = block.Number + 1
+			}
+			//keeps track of the point up to where we have received all the blocks
+			//with no missing blocks in between
+			for bs.Test(uint(gaplessToBlock+1)) && gaplessToBlock < numBlocks {
+				gaplessToBlock++
+			}
+			//if we meet our retransmit criteria, send message to server
+			if shouldRetransmit(bs.Count(), lastRetransmitTime, t.rtt.retransmitInterval()) {
+				//send the error rate
+				sendErrorRate(receivedBlocks, missedBlocks, controlConn, e)
+				if len(streams) > 1 {
+					sendPathErrorRates(pathErrorRates(streams, streamSamples), controlConn, e)
+				}
+				//request the retransmit, leaving the blocks that
+				//could still turn up for later
+				holdback := retransmitHoldback(expectedBlock, t.config())
+				held := retransmitBlocks.from(holdback)
+				requestRetransmit(retransmitBlocks.truncate(holdback), bs, controlConn, e, false)
+				retransmitBlocks = held
+				lastRetransmitTime = time.Now()
+				missedBlocks = 0
+				receivedBlocks = 0
+			}
+			//finally, update progress
+			elapsed := time.Since(start).Seconds()
+			t.updateProgress(Progress{Type: TRANSFERRING, Message: "Downloading...", Percentage: float64(bs.Count()) / float64(numBlocks), RTT: t.rtt.rtt(),
+				Throughput:     float64(fileBytes) / elapsed,
+				WireThroughput: float64(wireBytes) / elapsed})
 		}
-		//finally, update progress
-		t.updateProgress(Progress{Type: TRANSFERRING, Message: "Downloading...", Percentage: float64(bs.Count()) / float64(numBlocks)})
 	}
 }
 
-func shouldRetransmit(numBlocks uint, lastRetransmitTime time.Time) bool {
-	now := time.Now()
-	delta := now.Sub(lastRetransmitTime)
-	if numBlocks%retransmitIteration == 0 && delta > retransmitTimeDelta {
-		return true
+// reorderWindow is how far behind the newest block others can still
+// turn up, without having been lost
+func reorderWindow(c Config) int {
+	if c.DataStreams <= 1 {
+		return 0
 	}
-	return false
+	return c.DataStreams * c.BatchSize
 }
 
-func insertRetransmitBlock(blocks []int, block int) []int {
-	if len(blocks) == 0 {
-		blocks = append(blocks, block)
-
-		return blocks
+// retransmitHoldback is the first block that might still arrive, late
+// or rebuilt from parity, when the next block expected is expectedBlock
+func retransmitHoldback(expectedBlock int, c Config) int {
+	holdback := expectedBlock - reorderWindow(c)
+	if c.FECDataShards > 0 && holdback > 0 {
+		//the parity for a group comes after all of its blocks
+		holdback = (holdback - 1) / c.FECDataShards * c.FECDataShards
 	}
-	i := sort.Search(len(blocks), func(i int) bool { return blocks[i] >= block })
-	// block is not present in data,
-	// but i is the index where it would be inserted.
-	if !(i < len(blocks) && blocks[i] == block) {
-		newBlocks := make([]int, len(blocks)+1)
-		copy(newBlocks, blocks)
-
-		for j := i; j < len(blocks); j++ {
-			newBlocks[j+1] = blocks[j]
-		}
+	if holdback < 0 {
+		return 0
+	}
+	return holdback
+}
 
-		newBlocks[i] = block
-		blocks = newBlocks
+func shouldRetransmit(numBlocks uint, lastRetransmitTime time.Time, interval time.Duration) bool {
+	now := time.Now()
+	delta := now.Sub(lastRetransmitTime)
+	if numBlocks%retransmitIteration == 0 && delta > interval {
+		return true
 	}
-	return blocks
+	return false
 }
 
-func requestRetransmit(blocks []int, bs *bitset.BitSet, conn net.Conn, e Encoder, isRestart bool) {
+func requestRetransmit(blocks rangeList, bs *bitset.BitSet, conn net.Conn, e Encoder, isRestart bool) {
 	if len(blocks) <= 0 {
 		return
 	}
-	var missingBlocks []int
+	var payload Retransmit
 	if isRestart {
-		missingBlocks = blocks[0:1]
+		payload = Retransmit{IsRestart: true, Base: blocks[0].start}
 	} else {
-		for _, b := range blocks {
-			if !bs.Test(uint(b)) {
-				missingBlocks = append(missingBlocks, b)
-			}
+		missing := blocks.missing(bs)
+		if len(missing) == 0 {
+			return
 		}
+		base, ranges := encodeRanges(missing)
+		payload = Retransmit{Base: base, Ranges: ranges}
 	}
-
-	payload := Retransmit{IsRestart: isRestart, BlockNums: missingBlocks}
 	pkt := Packet{Type: RETRANSMIT, Payload: payload}
 	_, err := sendPacket(&pkt, conn, e)
 	if err != nil {
@@ -190,6 +319,14 @@ func requestRetransmit(blocks []int, bs *bitset.BitSet, conn net.Conn, e Encoder
 	}
 }
 
+// requestMissing asks for every block up to lastBlock that hasn't
+// arrived, falling back to a restart from the first of them if that is
+// too many ranges for one request
+func requestMissing(lastBlock int, bs *bitset.BitSet, conn net.Conn, e Encoder, c Config) {
+	missing := rangeList{{0, lastBlock + 1}}.missing(bs)
+	requestRetransmit(missing, bs, conn, e, len(missing) > c.MaxMissedLength)
+}
+
 func sendErrorRate(receivedBlocks int, missedBlocks int, conn net.Conn, e Encoder) {
 	percent := float64(missedBlocks) / float64(missedBlocks+receivedBlocks)
 	pkt := Packet{Type: ERROR_RATE, Payload: percent}
@@ -199,9 +336,50 @@ func sendErrorRate(receivedBlocks int, missedBlocks int, conn net.Conn, e Encode
 	}
 }
 
-func writeData(data []byte, offset int, fo *os.File) {
-	_, err := fo.WriteAt(data, int64(offset))
+func sendPathErrorRates(rates []float64, conn net.Conn, e Encoder) {
+	pkt := Packet{Type: ERROR_RATES, Payload: PathErrorRates{Rates: rates}}
+	_, err := sendPacket(&pkt, conn, e)
+	if err != nil {
+		log.Println("Error sending error rates: " + err.Error())
+	}
+}
+
+// resetTimer restarts timer for d. it may have fired while something
+// else was being handled, so the stale tick is drained first rather than
+// cutting the new timeout short
+func resetTimer(timer *time.Timer, d time.Duration) {
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+	timer.Reset(d)
+}
+
+func writeData(data []byte, offset int64, fo *os.File) {
+	_, err := fo.WriteAt(data, offset)
 	if err != nil {
 		log.Println("Error writing to file: " + err.Error())
 	}
 }
+
+// sendPings timestamps the control channel every so often, the server
+// echoes them back as PONGs to measure the round trip time
+func sendPings(conn net.Conn, e Encoder, done chan bool) {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+	for {
+		pkt := Packet{Type: PING, Payload: time.Now().UnixNano()}
+		_, err := sendPacket(&pkt, conn, e)
+		if err != nil {
+			log.Println("Error sending PING: " + err.Error())
+			return
+		}
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package gonami
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sync"
+)
+
+// a block received has to fit the buffers of BlockSize it is copied into
+var errBlockTooLarge = errors.New("Block is larger than the block size")
+
+type datagram struct {
+	data []byte
+	err  error
+}
+
+type decodedBlock struct {
+	block    Block
+	wireSize int //size of the block data as it was received
+	err      error
+	skip     bool //the datagram wasn't a block, it only keeps its place in the order
+}
+
+// startReceivePipeline splits the receive path over several goroutines,
+// connected by bounded queues, so that the sockets keep being drained
+// while blocks are decoded and accounted for. each data stream gets its
+// own pipeline, and their blocks are merged as they come. when there
+// are several streams, what arrives on each is counted in its stats.
+// with a proxy, relays has the relay of each of conns, only datagrams
+// from it are taken and they have its header stripped off
+func startReceivePipeline(e Encoder, conns []net.PacketConn, relays []*net.UDPAddr, c Config, blockPool *bufferPool, done chan bool) (<-chan decodedBlock, []*streamStats) {
+	relayOf := func(i int) *net.UDPAddr {
+		if relays == nil {
+			return nil
+		}
+		return relays[i]
+	}
+	if len(conns) == 1 {
+		return startStreamPipeline(e, conns[0], relayOf(0), c, blockPool, done), nil
+	}
+	merged := make(chan decodedBlock, c.ReceiveQueueLength)
+	stats := make([]*streamStats, len(conns))
+	var wg sync.WaitGroup
+	for i, conn := range conns {
+		stats[i] = &streamStats{}
+		wg.Add(1)
+		go func(stream <-chan decodedBlock, stats *streamStats) {
+			defer wg.Done()
+			for d := range stream {
+				if d.err == nil && d.block.Seq > 0 {
+					stats.add(d.block.Seq)
+				}
+				select {
+				case merged <- d:
+				case <-done:
+					return
+				}
+			}
+		}(startStreamPipeline(e, conn, relayOf(i), c, blockPool, done), stats[i])
+	}
+	go func() {
+		wg.Wait()
+		close(merged)
+	}()
+	return merged, stats
+}
+
+// startStreamPipeline is the receive path of a single socket. the
+// reader deals datagrams out round robin to the decoders, and they are
+// merged back in the same order, so blocks come out in the order they
+// arrived
+func startStreamPipeline(e Encoder, conn net.PacketConn, relay *net.UDPAddr, c Config, blockPool *bufferPool, done chan bool) <-chan decodedBlock {
+	workers := c.ReceiveWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	queue := c.ReceiveQueueLength / workers
+	if queue < 1 {
+		queue = 1
+	}
+	rawPool := newBufferPool(c.BlockSize+500, c.ReceiveQueueLength+c.BatchSize)
+	ins := make([]chan datagram, workers)
+	outs := make([]chan decodedBlock, workers)
+	for i := range ins {
+		ins[i] = make(chan datagram, queue)
+		outs[i] = make(chan decodedBlock, queue)
+		go decodeDatagrams(e, c, ins[i], outs[i], rawPool, blockPool, done)
+	}
+	merged := make(chan decodedBlock, queue)
+	go readDatagrams(conn, c.BatchSize, relay, rawPool, ins, done)
+	go mergeDecoded(outs, merged, done)
+	return merged
+}
+
+func readDatagrams(conn net.PacketConn, batchSize int, relay *net.UDPAddr, rawPool *bufferPool, ins []chan datagram, done chan bool) {
+	defer func() {
+		for _, in := range ins {
+			close(in)
+		}
+	}()
+	reader := newBatchReader(conn, batchSize, rawPool.size)
+	//the decoder the next datagram goes to, only moved on for the ones
+	//passed on so that the merge puts them back in order
+	next := 0
+	for {
+		var dg datagram
+		buf, err := reader.read()
+		if err == nil && relay != nil {
+			//anything not from the relay, or not wrapped by it, isn't ours
+			var ok bool
+			if buf, ok = socksPayload(buf); !ok || !sameUDPAddr(reader.from(), relay) {
+				continue
+			}
+		}
+		if err != nil {
+			dg.err = err
+		} else {
+			//copy out of the socket buffers so the next batch can be read
+			dg.data = rawPool.get()
+			dg.data = dg.data[:copy(dg.data, buf)]
+		}
+		select {
+		case ins[next] <- dg:
+		case <-done:
+			return
+		}
+		if err != nil {
+			return
+		}
+		next = (next + 1) % len(ins)
+	}
+}
+
+func decodeDatagrams(e Encoder, c Config, in chan datagram, out chan decodedBlock, rawPool *bufferPool, blockPool *bufferPool, done chan bool) {
+	defer close(out)
+	var decompressor *blockDecompressor
+	if c.Compression != NO_COMPRESSION {
+		decompressor = newBlockDecompressor()
+		defer decompressor.close()
+	}
+	for dg := range in {
+		var d decodedBlock
+		if dg.err != nil {
+			d.err = dg.err
+		} else if isMTUProbe(dg.data) || isPathChallenge(dg.data) {
+			//a straggler from the handshake
+			rawPool.put(dg.data)
+			d.skip = true
+		} else {
+			var block Block
+			err := decodeBlock(e, dg.data, &block)
+			if err == nil {
+				d = copyBlock(block, blockPool, decompressor)
+				err = d.err
+			}
+			rawPool.put(dg.data)
+			if err != nil {
+				//anyone can send to the port, so it isn't the end of
+				//the download
+				log.Println("Dropping datagram: " + err.Error())
+				d = decodedBlock{skip: true}
+			}
+		}
+		select {
+		case out <- d:
+		case <-done:
+			return
+		}
+	}
+}
+
+// copyBlock copies block out of the buffer it was decoded from, into
+// one from blockPool, decompressing it on the way if need be
+func copyBlock(block Block, blockPool *bufferPool, decompressor *blockDecompressor) decodedBlock {
+	d := decodedBlock{wireSize: len(block.Data)}
+	data := blockPool.get()
+	if block.Compressed {
+		data, d.err = decompressor.decompress(block.Data, data)
+	} else if len(block.Data) > len(data) {
+		//rather than cut it short
+		blockPool.put(data)
+		data, d.err = nil, errBlockTooLarge
+	} else {
+		data = data[:copy(data, block.Data)]
+	}
+	d.block = Block{Number: block.Number, Data: data, Type: block.Type, Shard: block.Shard, Parity: block.Parity, Seq: block.Seq}
+	return d
+}
+
+func mergeDecoded(outs []chan decodedBlock, merged chan decodedBlock, done chan bool) {
+	defer close(merged)
+	for next := 0; ; next = (next + 1) % len(outs) {
+		select {
+		case d, ok := <-outs[next]:
+			if !ok {
+				return
+			}
+			if d.skip {
+				continue
+			}
+			select {
+			case merged <- d:
+			case <-done:
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package gonami
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+const (
+	lossBlocks     = 20000
+	lossBlockSize  = 1400
+	lossPacketRate = 50000 //datagrams per second
+	//every lossStallEvery blocks the consumer stalls for lossStall, as
+	//it might for a garbage collection or a slow write
+	lossStallEvery = 1000
+	lossStall      = 5 * time.Millisecond
+	lossIdle       = 200 * time.Millisecond
+)
+
+// sendLossBlocks paces lossBlocks blocks out to addr from tx, in
+// batches
+func sendLossBlocks(tx net.PacketConn, addr net.Addr, e Encoder) error {
+	w := newBatchWriter(tx, addr, 32)
+	block := Block{Data: make([]byte, lossBlockSize)}
+	start := time.Now()
+	for i := 0; i < lossBlocks; i++ {
+		block.Number = i
+		b, err := appendBlock(e, w.buf(), &block)
+		if err != nil {
+			return err
+		}
+		w.add(b)
+		if w.full() || i == lossBlocks-1 {
+			if err := w.flush(); err != nil {
+				return err
+			}
+			time.Sleep(time.Until(start.Add(time.Duration(i+1) * time.Second / lossPacketRate)))
+		}
+	}
+	return nil
+}
+
+// benchmarkReceiveLoss reports the percentage of blocks lost by a
+// receiver whose consumer stalls now and again, with the socket read
+// and decoded either inline or by the receive pipeline
+func benchmarkReceiveLoss(b *testing.B, pipelined bool) {
+	e := BsonEncoder{}
+	c := NewConfig()
+	c.BlockSize = lossBlockSize
+	var lost int
+	for i := 0; i < b.N; i++ {
+		rx, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			b.Fatal(err)
+		}
+		//the same for both, whatever the system's default
+		rx.SetReadBuffer(256 << 10)
+		tx, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			b.Fatal(err)
+		}
+		go sendLossBlocks(tx, rx.LocalAddr(), e)
+
+		pool := newBufferPool(c.BlockSize, c.ReceiveQueueLength)
+		received := 0
+		consume := func(d decodedBlock) {
+			if d.err != nil {
+				return
+			}
+			received++
+			pool.put(d.block.Data)
+			if received%lossStallEvery == 0 {
+				time.Sleep(lossStall)
+			}
+		}
+		if pipelined {
+			done := make(chan bool)
+			blocks := startStreamPipeline(e, rx, nil, c, pool, done)
+		receive:
+			for received < lossBlocks {
+				select {
+				case d := <-blocks:
+					consume(d)
+				case <-time.After(lossIdle):
+					break receive
+				}
+			}
+			close(done)
+		} else {
+			r := newBatchReader(rx, c.BatchSize, c.BlockSize+500)
+			for received < lossBlocks {
+				rx.SetReadDeadline(time.Now().Add(lossIdle))
+				data, err := r.read()
+				if err != nil {
+					break
+				}
+				var block Block
+				d := decodedBlock{err: decodeBlock(e, data, &block)}
+				if d.err == nil {
+					d = copyBlock(block, pool, nil)
+				}
+				consume(d)
+			}
+		}
+		rx.Close()
+		tx.Close()
+		lost += lossBlocks - received
+	}
+	b.ReportMetric(100*float64(lost)/float64(b.N*lossBlocks), "%lost")
+}
+
+func BenchmarkReceiveLossInline(b *testing.B) {
+	benchmarkReceiveLoss(b, false)
+}
+
+func BenchmarkReceiveLossPipelined(b *testing.B) {
+	benchmarkReceiveLoss(b, true)
+}
@@ -2,16 +2,18 @@ package gonami
 
 import (
 	"crypto/md5"
-	"fmt"
 	"log"
 	"net"
+	"path/filepath"
+	"time"
 )
 
-func onVersionConfirmedState(pkt *Packet, e Encoder, conn net.Conn, t transfer) stateFn {
+func onVersionConfirmedState(pkt *Packet, e Encoder, conn net.Conn, t transfer, sent time.Time) stateFn {
 	if pkt.Type != AUTH {
 		log.Println("Expecting AUTH, did not receive it")
 		return nil
 	}
+	t.(*clientTransfer).rtt.sample(time.Since(sent))
 	b, ok := pkt.Payload.([]byte)
 	if !ok {
 		log.Println("Incorrect payload type")
@@ -100,38 +102,378 @@ func acceptFileSizeState(pkt *Packet, e Encoder, conn net.Conn, t transfer) stat
 		log.Println("Incorrect payload type")
 		return nil
 	}
-	serverConn, err := getUDPServerConn()
+	//the server tells us which file it has, in case we can copy it
+	if t.config().OfferIdentity {
+		return acceptFileIdentityState
+	}
+	return sendDataPortsState(pkt, e, conn, t)
+}
+
+// acceptFileIdentityState takes the fast path when the server's file is
+// right here under Client.ServerDirectory, and otherwise carries on with the
+// data ports
+func acceptFileIdentityState(pkt *Packet, e Encoder, conn net.Conn, t transfer) stateFn {
+	if pkt.Type != FILE_IDENTITY {
+		log.Println("Expecting FILE_IDENTITY, did not receive it")
+		return nil
+	}
+	id, ok := pkt.Payload.(FileIdentity)
+	if !ok {
+		log.Println("Incorrect payload type")
+		return nil
+	}
+	src := openSameFile(id, filepath.Join(t.(*clientTransfer).serverDir, t.filename()))
+	outPkt := Packet{Type: FILE_IDENTITY, Payload: src != nil}
+	if _, err := sendPacket(&outPkt, conn, e); err != nil {
+		log.Println("Error sending FILE_IDENTITY packet: " + err.Error())
+		if src != nil {
+			src.Close()
+		}
+		return nil
+	}
+	if src == nil {
+		return sendDataPortsState(pkt, e, conn, t)
+	}
+	ct := t.(*clientTransfer)
+	ct.local = true
+	t.updateProgress(Progress{Type: HANDSHAKING, Message: "Handshaking complete. Copying the server's file", Percentage: 1})
+	go copyLocally(src, e, conn, ct)
+	return downloadingState
+}
+
+func sendDataPortsState(pkt *Packet, e Encoder, conn net.Conn, t transfer) stateFn {
+	//a nil address listens on every interface, and leaves the server
+	//to send to the address we connected from. without any, the data
+	//only comes over TCP
+	locals := []*net.UDPAddr{nil}
+	if t.config().Transport == TCP_TRANSPORT {
+		locals = nil
+	} else if t.config().ListenAddr != "" {
+		local, err := bindAddr(t.config().ListenAddr)
+		if err != nil {
+			errMsg := "Error resolving listen address: " + err.Error()
+			log.Println(errMsg)
+			t.updateProgress(Progress{Type: ERROR, Message: errMsg, Percentage: 0})
+			return nil
+		}
+		locals[0] = local
+	} else if t.config().Multipath {
+		if pathIPs := localPathIPs(conn, t.(*clientTransfer).network); len(pathIPs) > 0 {
+			locals = nil
+			for _, ip := range pathIPs {
+				locals = append(locals, &net.UDPAddr{IP: ip})
+			}
+		}
+	}
+	var serverConns []net.PacketConn
+	var ports DataPorts
+	for _, local := range locals {
+		binding := dataBinding{network: t.(*clientTransfer).network, local: local, portMin: t.config().ListenPort,
+			portMax: t.config().ListenPortMax}
+		pathConns, err := getUDPServerConn(binding, t.config().DataStreams)
+		if err != nil {
+			errMsg := "Error starting listening connection: " + err.Error()
+			log.Println(errMsg)
+			t.updateProgress(Progress{Type: ERROR, Message: errMsg, Percentage: 0})
+			closeConns(serverConns)
+			return nil
+		}
+		for _, serverConn := range pathConns {
+			host := ""
+			if local != nil && !local.IP.IsUnspecified() {
+				host = local.IP.String()
+			}
+			ports.Ports = append(ports.Ports, udpAddr(serverConn.LocalAddr()).Port)
+			ports.Hosts = append(ports.Hosts, host)
+		}
+		serverConns = append(serverConns, pathConns...)
+	}
+	if ct := t.(*clientTransfer); ct.proxy != nil && len(serverConns) > 0 {
+		if err := relayStreams(ct, len(serverConns)); err != nil {
+			errMsg := "Proxy can't relay the data: " + err.Error()
+			log.Println(errMsg)
+			closeConns(serverConns)
+			if t.config().Transport == UDP_TRANSPORT {
+				t.updateProgress(Progress{Type: ERROR, Message: errMsg, Percentage: 0})
+				return nil
+			}
+			t.updateProgress(Progress{Type: WARNING, Message: errMsg + ", it will come over TCP", Percentage: 1})
+			serverConns = nil
+			ports = DataPorts{}
+		}
+	}
+	if len(serverConns) > 0 {
+		size := socketBufferSize(float64(t.config().TransferRate)/8/float64(len(serverConns)), t.(*clientTransfer).rtt.rtt())
+		if warning := tuneSocketBuffers(serverConns, size, true); warning != "" {
+			log.Println(warning)
+			t.updateProgress(Progress{Type: WARNING, Message: warning, Percentage: 1})
+		}
+	}
+	outPkt := Packet{Type: DATA_PORTS, Payload: ports}
+	_, err := sendPacket(&outPkt, conn, e)
 	if err != nil {
-		errMsg := "Error starting listening connection: " + err.Error()
-		log.Println(errMsg)
-		t.updateProgress(Progress{Type: ERROR, Message: errMsg, Percentage: 0})
+		log.Println("Error sending DATA_PORTS packet: " + err.Error())
+		closeConns(serverConns)
+		return nil
+	}
+	if t.config().Passive && len(serverConns) > 0 {
+		acceptServerPortsStateWrapper := func(pkt1 *Packet, e1 Encoder, conn1 net.Conn, t1 transfer) stateFn {
+			return acceptServerPortsState(pkt1, e1, conn1, t1, serverConns, ports.Hosts)
+		}
+		return acceptServerPortsStateWrapper
+	}
+	if namesHosts(ports.Hosts) {
+		answerPathChallengeStateWrapper := func(pkt1 *Packet, e1 Encoder, conn1 net.Conn, t1 transfer) stateFn {
+			return answerPathChallengeState(pkt1, e1, conn1, t1, serverConns, ports.Hosts)
+		}
+		return answerPathChallengeStateWrapper
+	}
+	return startPathProbes(e, conn, t, serverConns, ports.Hosts)
+}
+
+// answerPathChallengeState echoes back the nonces the server sent down
+// the data streams it has to check we receive on
+func answerPathChallengeState(pkt *Packet, e Encoder, conn net.Conn, t transfer, serverConns []net.PacketConn, hosts []string) stateFn {
+	if pkt.Type != PATH_CHALLENGE {
+		log.Println("Expecting PATH_CHALLENGE, did not receive it")
+		closeConns(serverConns)
+		return nil
+	}
+	challenge, ok := pkt.Payload.(PathChallenge)
+	if !ok {
+		log.Println("Incorrect payload type")
+		closeConns(serverConns)
+		return nil
+	}
+	if len(challenge.Streams) == 0 {
+		return startPathProbes(e, conn, t, serverConns, hosts)
+	}
+	t.updateProgress(Progress{Type: HANDSHAKING, Message: "Verifying data paths", Percentage: 1})
+	deadline := time.Now().Add(challengeTimeout)
+	reply := PathChallenge{Streams: challenge.Streams}
+	for _, i := range challenge.Streams {
+		if i < 0 || i >= len(serverConns) {
+			log.Println("Incorrect payload type")
+			closeConns(serverConns)
+			return nil
+		}
+		nonce, err := readChallenge(serverConns[i], deadline)
+		if err != nil {
+			errMsg := "Data path to " + hosts[i] + " did not get through: " + err.Error()
+			log.Println(errMsg)
+			t.updateProgress(Progress{Type: ERROR, Message: errMsg, Percentage: 0})
+			closeConns(serverConns)
+			return nil
+		}
+		reply.Nonces = append(reply.Nonces, nonce)
+	}
+	outPkt := Packet{Type: PATH_CHALLENGE, Payload: reply}
+	if _, err := sendPacket(&outPkt, conn, e); err != nil {
+		log.Println("Error sending PATH_CHALLENGE packet: " + err.Error())
+		closeConns(serverConns)
+		return nil
+	}
+	return startPathProbes(e, conn, t, serverConns, hosts)
+}
+
+// acceptServerPortsState starts punching through to the ports a
+// passive server is listening on
+func acceptServerPortsState(pkt *Packet, e Encoder, conn net.Conn, t transfer, serverConns []net.PacketConn, hosts []string) stateFn {
+	if pkt.Type != DATA_PORTS {
+		log.Println("Expecting DATA_PORTS, did not receive it")
+		closeConns(serverConns)
+		return nil
+	}
+	ports, ok := pkt.Payload.(DataPorts)
+	if !ok || len(ports.Ports) != len(serverConns) || len(ports.Token) == 0 {
+		log.Println("Incorrect payload type")
+		closeConns(serverConns)
 		return nil
 	}
-	listeningPort := serverConn.LocalAddr().(*net.UDPAddr).Port
-	outPkt := Packet{Type: GET_FILE, Payload: listeningPort}
-	_, err = sendPacket(&outPkt, conn, e)
+	ct := t.(*clientTransfer)
+	ip := udpAddr(conn.RemoteAddr()).IP
+	addrs := make([]net.Addr, len(ports.Ports))
+	punches := make([][]byte, len(ports.Ports))
+	for i, port := range ports.Ports {
+		addrs[i] = &net.UDPAddr{IP: ip, Port: port}
+		punches[i] = punchPacket(ports.Token, i)
+		if len(ct.associations) > 0 {
+			//through the proxy's relay, which the server then sends to
+			punch, err := ct.proxy.datagram(ct.serverHost, port, punches[i])
+			if err != nil {
+				log.Println("Error addressing punch: " + err.Error())
+				closeConns(serverConns)
+				return nil
+			}
+			addrs[i] = ct.associations[i].relay
+			punches[i] = punch
+		}
+	}
+	t.updateProgress(Progress{Type: HANDSHAKING, Message: "Opening data paths", Percentage: 1})
+	opened := startPunching(serverConns, addrs, punches)
+	punchedStateWrapper := func(pkt1 *Packet, e1 Encoder, conn1 net.Conn, t1 transfer) stateFn {
+		return punchedState(pkt1, e1, conn1, t1, serverConns, hosts, opened)
+	}
+	return punchedStateWrapper
+}
+
+func punchedState(pkt *Packet, e Encoder, conn net.Conn, t transfer, serverConns []net.PacketConn, hosts []string, opened chan bool) stateFn {
+	//from here on the punches just keep the NAT mappings alive
+	close(opened)
+	if pkt.Type != PUNCH {
+		log.Println("Expecting PUNCH, did not receive it")
+		closeConns(serverConns)
+		return nil
+	}
+	return startPathProbes(e, conn, t, serverConns, hosts)
+}
+
+// startPathProbes sets up for the MTU probes the server sends once the
+// data paths are open, or goes straight to downloading without them
+func startPathProbes(e Encoder, conn net.Conn, t transfer, serverConns []net.PacketConn, hosts []string) stateFn {
+	if !needsPathProbes(t.config()) {
+		t.(*clientTransfer).transport = UDP_TRANSPORT
+		return startDownload(e, conn, serverConns, t)
+	}
+	t.updateProgress(Progress{Type: HANDSHAKING, Message: "Probing data paths", Percentage: 1})
+	//the probes go to the first stream of each path
+	var probers []*mtuProbeReader
+	for _, i := range pathStarts(hosts) {
+		probers = append(probers, newMTUProbeReader(serverConns[i], len(t.(*clientTransfer).associations) > 0))
+	}
+	probeDoneStateWrapper := func(pkt1 *Packet, e1 Encoder, conn1 net.Conn, t1 transfer) stateFn {
+		return probeDoneState(pkt1, e1, conn1, t1, serverConns, probers)
+	}
+	return probeDoneStateWrapper
+}
+
+func probeDoneState(pkt *Packet, e Encoder, conn net.Conn, t transfer, serverConns []net.PacketConn, probers []*mtuProbeReader) stateFn {
+	//the number of probes the server sent, with none there is no
+	//point waiting for them
+	grace := probeGrace
+	if sent, ok := pkt.Payload.(int); ok && sent == 0 {
+		grace = 0
+	}
+	//blocks have to fit down every path
+	largestProbe := 0
+	for i, prober := range probers {
+		if largest := prober.stop(grace); i == 0 || largest < largestProbe {
+			largestProbe = largest
+		}
+	}
+	if pkt.Type != MTU_PROBE {
+		log.Println("Expecting MTU_PROBE, did not receive it")
+		closeConns(serverConns)
+		return nil
+	}
+	outPkt := Packet{Type: MTU_PROBE, Payload: largestProbe}
+	_, err := sendPacket(&outPkt, conn, e)
 	if err != nil {
-		log.Println("Error sending GET_FILE packet: " + err.Error())
+		log.Println("Error sending MTU_PROBE packet: " + err.Error())
+		closeConns(serverConns)
 		return nil
 	}
+	acceptPathParamsStateWrapper := func(pkt1 *Packet, e1 Encoder, conn1 net.Conn, t1 transfer) stateFn {
+		return acceptPathParamsState(pkt1, e1, conn1, t1, serverConns)
+	}
+	return acceptPathParamsStateWrapper
+}
+
+func acceptPathParamsState(pkt *Packet, e Encoder, conn net.Conn, t transfer, serverConns []net.PacketConn) stateFn {
+	if pkt.Type != PATH_PARAMS {
+		log.Println("Expecting PATH_PARAMS, did not receive it")
+		closeConns(serverConns)
+		return nil
+	}
+	params, ok := pkt.Payload.(PathParams)
+	if !ok || params.BlockSize <= 0 {
+		log.Println("Incorrect payload type")
+		closeConns(serverConns)
+		return nil
+	}
+	ct := t.(*clientTransfer)
+	ct.c.BlockSize = params.BlockSize
+	ct.transport = params.Transport
+	if ct.transport == TCP_TRANSPORT {
+		//the data comes in on the control connection instead
+		closeConns(serverConns)
+		serverConns = nil
+	}
+	return startDownload(e, conn, serverConns, t)
+}
+
+func startDownload(e Encoder, conn net.Conn, serverConns []net.PacketConn, t transfer) stateFn {
+	ct := t.(*clientTransfer)
+	if ct.transport == TCP_TRANSPORT {
+		ct.tcp = newTCPReceiver(ct.c)
+	}
 	t.updateProgress(Progress{Type: HANDSHAKING, Message: "Handshaking complete. Starting Download", Percentage: 1})
-	go handleDownload(e, conn, serverConn, t.(*clientTransfer))
-	return transferDoneState
+	go handleDownload(e, conn, serverConns, ct)
+	return downloadingState
 }
+
+func downloadingState(pkt *Packet, e Encoder, conn net.Conn, t transfer) stateFn {
+	switch pkt.Type {
+	case PONG:
+		sent, ok := pkt.Payload.(int64)
+		if !ok {
+			log.Println("Incorrect payload type")
+			return downloadingState
+		}
+		t.(*clientTransfer).rtt.sample(time.Since(time.Unix(0, sent)))
+	case END_OF_PASS:
+		lastBlock, ok := pkt.Payload.(int)
+		if !ok {
+			log.Println("Incorrect payload type")
+			return downloadingState
+		}
+		//never block here, the download may already be wrapping up
+		select {
+		case t.(*clientTransfer).controlCh <- controlMsg{msgType: END_OF_PASS, payload: lastBlock}:
+		default:
+		}
+	case DATA:
+		block, ok := pkt.Payload.(Block)
+		if !ok || t.(*clientTransfer).tcp == nil {
+			log.Println("Incorrect payload type")
+			return downloadingState
+		}
+		t.(*clientTransfer).tcp.receive(block)
+	case TRANSFER_ERROR:
+		reason, _ := pkt.Payload.(string)
+		errMsg := "Server ended the transfer: " + reason
+		log.Println(errMsg)
+		t.updateProgress(Progress{Type: ERROR, Message: errMsg, Percentage: 0})
+		close(t.(*clientTransfer).aborted)
+		return nil
+	case DONE:
+		if tcp := t.(*clientTransfer).tcp; tcp != nil {
+			tcp.close()
+		}
+		return transferDoneState(pkt, e, conn, t)
+	}
+	return downloadingState
+}
+
 func transferDoneState(pkt *Packet, e Encoder, conn net.Conn, t transfer) stateFn {
 	t.updateProgress(Progress{Type: TRANSFER_DONE, Message: "Transfer Done", Percentage: 100})
 	return nil
 }
 
-func getUDPServerConn() (*net.UDPConn, error) {
-	serverAddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf(":%d", 0))
-	if err != nil {
-		return nil, err
+// getUDPServerConn opens a listener for each of the n data streams of
+// a path
+func getUDPServerConn(binding dataBinding, n int) ([]net.PacketConn, error) {
+	if n < 1 {
+		n = 1
 	}
-
-	serverConn, err := net.ListenUDP("udp", serverAddr)
-	if err != nil {
-		return nil, err
+	var serverConns []net.PacketConn
+	for i := 0; i < n; i++ {
+		serverConn, err := binding.listen()
+		if err != nil {
+			closeConns(serverConns)
+			return nil, err
+		}
+		serverConns = append(serverConns, serverConn)
 	}
-	return serverConn, nil
+	return serverConns, nil
 }
@@ -0,0 +1,137 @@
+package gonami
+
+import (
+	"os"
+	"time"
+)
+
+type extent struct {
+	data    []byte
+	filled  []bool
+	count   int
+	touched time.Time
+}
+
+// extentWriter gathers received blocks into large contiguous extents of
+// the file, so that the disk sees a few big writes instead of one small
+// write per block. extents are written out once they are full, when they
+// have been idle for a while, or when memory runs short
+type extentWriter struct {
+	fo           *os.File
+	filesize     int64
+	blockSize    int
+	extentBlocks int
+	maxExtents   int
+	timeout      time.Duration
+	extents      map[int]*extent
+	pool         *bufferPool
+}
+
+func newExtentWriter(fo *os.File, filesize int64, c Config) *extentWriter {
+	extentBlocks := c.WriteExtentSize / c.BlockSize
+	if extentBlocks < 1 {
+		extentBlocks = 1
+	}
+	maxExtents := c.WriteBufferSize / (extentBlocks * c.BlockSize)
+	if maxExtents < 1 {
+		maxExtents = 1
+	}
+	timeout := time.Duration(c.WriteFlushTime) * time.Millisecond
+	if timeout <= 0 {
+		timeout = defaultWriteFlushTime * time.Millisecond
+	}
+	return &extentWriter{fo: fo, filesize: filesize, blockSize: c.BlockSize,
+		extentBlocks: extentBlocks,
+		maxExtents:   maxExtents,
+		timeout:      timeout,
+		extents:      make(map[int]*extent),
+		pool:         newBufferPool(extentBlocks*c.BlockSize, maxExtents)}
+}
+
+// write copies block into its extent. the block's data can be reused
+// as soon as write returns
+func (w *extentWriter) write(block Block) {
+	idx := block.Number / w.extentBlocks
+	ext, ok := w.extents[idx]
+	if !ok {
+		if len(w.extents) >= w.maxExtents {
+			w.flush(w.oldest())
+		}
+		ext = &extent{data: w.pool.get(), filled: make([]bool, w.extentBlocks)}
+		w.extents[idx] = ext
+	}
+	i := block.Number % w.extentBlocks
+	copy(ext.data[i*w.blockSize:(i+1)*w.blockSize], block.Data)
+	if !ext.filled[i] {
+		ext.filled[i] = true
+		ext.count++
+	}
+	ext.touched = time.Now()
+	if ext.count == w.blocksIn(idx) {
+		w.flush(idx)
+	}
+}
+
+// blocksIn is the number of blocks in extent idx, which is less than
+// extentBlocks for the one holding the end of the file
+func (w *extentWriter) blocksIn(idx int) int {
+	numBlocks := int((w.filesize + int64(w.blockSize) - 1) / int64(w.blockSize))
+	n := numBlocks - idx*w.extentBlocks
+	if n > w.extentBlocks {
+		return w.extentBlocks
+	}
+	return n
+}
+
+func (w *extentWriter) oldest() int {
+	oldest := -1
+	for idx, ext := range w.extents {
+		if oldest == -1 || ext.touched.Before(w.extents[oldest].touched) {
+			oldest = idx
+		}
+	}
+	return oldest
+}
+
+// flushIdle writes out the extents that haven't seen a block in a while
+func (w *extentWriter) flushIdle() {
+	for idx, ext := range w.extents {
+		if time.Since(ext.touched) > w.timeout {
+			w.flush(idx)
+		}
+	}
+}
+
+func (w *extentWriter) flushAll() {
+	for idx := range w.extents {
+		w.flush(idx)
+	}
+}
+
+// flush writes every contiguous run of received blocks in extent idx
+// and releases the extent
+func (w *extentWriter) flush(idx int) {
+	ext, ok := w.extents[idx]
+	if !ok {
+		return
+	}
+	delete(w.extents, idx)
+	base := int64(idx) * int64(w.extentBlocks) * int64(w.blockSize)
+	for i := 0; i < w.extentBlocks; {
+		if !ext.filled[i] {
+			i++
+			continue
+		}
+		start := i
+		for i < w.extentBlocks && ext.filled[i] {
+			i++
+		}
+		//the last block of the file is usually short
+		end := int64(i * w.blockSize)
+		if base+end > w.filesize {
+			end = w.filesize - base
+		}
+		writeData(ext.data[start*w.blockSize:end], base+int64(start*w.blockSize), w.fo)
+	}
+	w.pool.put(ext.data)
+}
@@ -0,0 +1,106 @@
+package gonami
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// extentConfig has blocks of 10 bytes, 3 to an extent, and room to
+// buffer 2 extents
+func extentConfig() Config {
+	c := NewConfig()
+	c.BlockSize = 10
+	c.WriteExtentSize = 35
+	c.WriteBufferSize = 60
+	return c
+}
+
+func createExtentFile(t *testing.T) *os.File {
+	fo, err := os.Create(filepath.Join(t.TempDir(), "f"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { fo.Close() })
+	return fo
+}
+
+func blockOf(src []byte, number int, blockSize int) Block {
+	end := min((number+1)*blockSize, len(src))
+	return Block{Number: number, Data: append([]byte{}, src[number*blockSize:end]...)}
+}
+
+// TestExtentWriterOutOfOrder writes the blocks in a random order, which
+// has extents flushed for room as well as when they fill up
+func TestExtentWriterOutOfOrder(t *testing.T) {
+	c := extentConfig()
+	//the last block is short
+	src := make([]byte, 1234)
+	rand.Read(src)
+	fo := createExtentFile(t)
+	w := newExtentWriter(fo, int64(len(src)), c)
+	numBlocks := (len(src) + c.BlockSize - 1) / c.BlockSize
+	for _, number := range rand.New(rand.NewSource(1)).Perm(numBlocks) {
+		w.write(blockOf(src, number, c.BlockSize))
+	}
+	w.flushAll()
+	got, err := os.ReadFile(fo.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, src) {
+		t.Errorf("file differs, %d bytes written of %d", len(got), len(src))
+	}
+}
+
+// TestExtentWriterLastBlock checks the short last block ends the file
+// at filesize, when it is written last and when it is written first
+func TestExtentWriterLastBlock(t *testing.T) {
+	c := extentConfig()
+	src := make([]byte, 64)
+	rand.Read(src)
+	for _, order := range [][]int{{0, 1, 2, 3, 4, 5, 6}, {6, 5, 4, 3, 2, 1, 0}} {
+		fo := createExtentFile(t)
+		w := newExtentWriter(fo, int64(len(src)), c)
+		for _, number := range order {
+			w.write(blockOf(src, number, c.BlockSize))
+		}
+		//the last extent only has the one block, so it went out as soon
+		//as it was full
+		if len(w.extents) != 0 {
+			t.Errorf("order %v: %d extents still buffered", order, len(w.extents))
+		}
+		got, _ := os.ReadFile(fo.Name())
+		if !bytes.Equal(got, src) {
+			t.Errorf("order %v: file differs, %d bytes written of %d", order, len(got), len(src))
+		}
+	}
+}
+
+func TestExtentWriterIdleFlush(t *testing.T) {
+	c := extentConfig()
+	c.WriteFlushTime = 20
+	src := make([]byte, 100)
+	rand.Read(src)
+	fo := createExtentFile(t)
+	w := newExtentWriter(fo, int64(len(src)), c)
+	w.write(blockOf(src, 0, c.BlockSize))
+	w.flushIdle()
+	if info, _ := fo.Stat(); info.Size() != 0 {
+		t.Fatalf("%d bytes written before the extent went idle", info.Size())
+	}
+	time.Sleep(2 * w.timeout)
+	//a block in another extent that has only just come in stays put
+	w.write(blockOf(src, 4, c.BlockSize))
+	w.flushIdle()
+	got, _ := os.ReadFile(fo.Name())
+	if !bytes.Equal(got, src[:c.BlockSize]) {
+		t.Errorf("got %x after the idle flush, want %x", got, src[:c.BlockSize])
+	}
+	if _, ok := w.extents[1]; !ok || len(w.extents) != 1 {
+		t.Errorf("extents buffered %v, want only extent 1", w.extents)
+	}
+}
@@ -0,0 +1,112 @@
+package gonami
+
+import (
+	"errors"
+	"log"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// compression algorithms a client can ask for in Config.Compression
+const (
+	NO_COMPRESSION = ""
+	ZSTD           = "zstd"
+)
+
+const (
+	//a block has to shrink by at least this fraction to be sent compressed
+	minCompressionSaving = 0.1
+	//after this many blocks in a row fail to compress, only every
+	//incompressibleProbe'th block is tried until one compresses again
+	incompressibleRun   = 16
+	incompressibleProbe = 64
+)
+
+func compressionSupported(name string) bool {
+	return name == NO_COMPRESSION || name == ZSTD
+}
+
+// blockCompressor compresses blocks on the server, sending them as is
+// whenever compressing doesn't pay off
+type blockCompressor struct {
+	enc     *zstd.Encoder
+	pool    *bufferPool
+	misses  int
+	skipped int
+}
+
+// newBlockCompressor returns nil if the data shouldn't be compressed
+func newBlockCompressor(name string, pool *bufferPool) *blockCompressor {
+	if name != ZSTD {
+		return nil
+	}
+	enc, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest), zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		log.Println("Error creating compressor: " + err.Error())
+		return nil
+	}
+	return &blockCompressor{enc: enc, pool: pool}
+}
+
+// compress replaces the data of block with its compressed form, if
+// that is enough smaller to be worth it
+func (c *blockCompressor) compress(block *Block) {
+	if c.misses >= incompressibleRun {
+		c.skipped++
+		if c.skipped < incompressibleProbe {
+			return
+		}
+		c.skipped = 0
+	}
+	buf := c.pool.get()
+	out := c.enc.EncodeAll(block.Data, buf[:0])
+	if float64(len(out)) > float64(len(block.Data))*(1-minCompressionSaving) {
+		c.misses++
+		c.pool.put(buf)
+		return
+	}
+	c.misses = 0
+	c.pool.put(block.Data)
+	block.Data = out
+	block.Compressed = true
+}
+
+func (c *blockCompressor) close() {
+	c.enc.Close()
+}
+
+// blockDecompressor undoes blockCompressor on the client
+type blockDecompressor struct {
+	dec *zstd.Decoder
+}
+
+func newBlockDecompressor() *blockDecompressor {
+	dec, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		log.Println("Error creating decompressor: " + err.Error())
+		return nil
+	}
+	return &blockDecompressor{dec: dec}
+}
+
+// decompress writes the data of a compressed block into buf, which
+// has to be large enough for a whole block
+func (d *blockDecompressor) decompress(data []byte, buf []byte) ([]byte, error) {
+	if d == nil {
+		return nil, errors.New("Unable to decompress block")
+	}
+	out, err := d.dec.DecodeAll(data, buf[:0])
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > cap(buf) {
+		return nil, errBlockTooLarge
+	}
+	return out, nil
+}
+
+func (d *blockDecompressor) close() {
+	if d != nil {
+		d.dec.Close()
+	}
+}
@@ -0,0 +1,39 @@
+package gonami
+
+import (
+	"errors"
+	"net"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// setDSCP marks what socket sends to remote with dscp, in the IPv4 TOS or
+// IPv6 traffic class field. an IPv6 socket sending to an IPv4 address
+// needs the IPv4 field set as well
+func setDSCP(socket interface{ LocalAddr() net.Addr }, remote net.IP, dscp int) error {
+	if dscp < 0 || dscp > 63 {
+		return errors.New("DSCP values go from 0 to 63")
+	}
+	//the system's sockets are all net.Conns, see Network
+	conn, ok := socket.(net.Conn)
+	if !ok {
+		return errors.New("Can't mark traffic on this socket")
+	}
+	//the DSCP is the top six bits, the rest is for ECN
+	tos := dscp << 2
+	if udpAddr(conn.LocalAddr()).IP.To4() != nil {
+		return ipv4.NewConn(conn).SetTOS(tos)
+	}
+	if err := ipv6.NewConn(conn).SetTrafficClass(tos); err != nil {
+		return err
+	}
+	if remote.To4() != nil {
+		return ipv4.NewConn(conn).SetTOS(tos)
+	}
+	return nil
+}
+
+func remoteIP(conn net.Conn) net.IP {
+	return udpAddr(conn.RemoteAddr()).IP
+}
@@ -1,6 +1,43 @@
 package gonami
 
+import "errors"
+
 type Encoder interface {
 	Encode(msg *Packet) ([]byte, error)
 	Decode(data []byte, numBytes int) (*Packet, error)
 }
+
+// blockEncoder is implemented by encoders with an allocation free path
+// for DATA packets, which make up nearly all the traffic of a transfer.
+// DecodeBlock may leave b.Data pointing into data
+type blockEncoder interface {
+	AppendBlock(buf []byte, b *Block) ([]byte, error)
+	DecodeBlock(data []byte, b *Block) error
+}
+
+func appendBlock(e Encoder, buf []byte, b *Block) ([]byte, error) {
+	if be, ok := e.(blockEncoder); ok {
+		return be.AppendBlock(buf, b)
+	}
+	data, err := e.Encode(&Packet{Type: DATA, Payload: *b})
+	if err != nil {
+		return nil, err
+	}
+	return append(buf, data...), nil
+}
+
+func decodeBlock(e Encoder, data []byte, b *Block) error {
+	if be, ok := e.(blockEncoder); ok {
+		return be.DecodeBlock(data, b)
+	}
+	pkt, err := e.Decode(data, len(data))
+	if err != nil {
+		return err
+	}
+	block, ok := pkt.Payload.(Block)
+	if !ok {
+		return errors.New("Incorrect payload type")
+	}
+	*b = block
+	return nil
+}
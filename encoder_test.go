@@ -0,0 +1,126 @@
+package gonami
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"testing"
+)
+
+// past an int32, which is encoded as an int64 where int is 64 bits
+var bigNumber = int64(math.MaxInt32) + 1
+
+var testBlocks = []Block{
+	{Number: 0, Data: []byte{}, Type: ORIGINAL},
+	{Number: 7, Data: []byte("some block data"), Type: RETRANSMITTED, Seq: 3},
+	{Number: 12, Data: bytes.Repeat([]byte{0xab}, 1400), Type: PARITY, Shard: 2, Parity: 1},
+	{Number: 1, Data: []byte{1, 2, 3}, Type: ORIGINAL, Compressed: true},
+	{Number: int(bigNumber), Data: []byte{0}, Type: ORIGINAL, Seq: int(bigNumber + 1)},
+}
+
+// TestBsonBlockRoundTrip checks the hand written DATA codec against
+// mgo's, in both directions
+func TestBsonBlockRoundTrip(t *testing.T) {
+	e := BsonEncoder{}
+	for _, block := range testBlocks {
+		appended, err := e.AppendBlock(nil, &block)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encoded, err := e.Encode(&Packet{Type: DATA, Payload: block})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(appended, encoded) {
+			t.Errorf("block %d: AppendBlock and Encode differ\n%x\n%x", block.Number, appended, encoded)
+		}
+
+		var decoded Block
+		if err := e.DecodeBlock(appended, &decoded); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(decoded, block) {
+			t.Errorf("DecodeBlock got %+v, want %+v", decoded, block)
+		}
+
+		pkt, err := e.Decode(appended, len(appended))
+		if err != nil {
+			t.Fatal(err)
+		}
+		viaMgo, ok := pkt.Payload.(Block)
+		if !ok {
+			t.Fatalf("Decode got a %T payload", pkt.Payload)
+		}
+		if viaMgo.Number != block.Number || !bytes.Equal(viaMgo.Data, block.Data) || viaMgo.Type != block.Type ||
+			viaMgo.Shard != block.Shard || viaMgo.Parity != block.Parity || viaMgo.Compressed != block.Compressed || viaMgo.Seq != block.Seq {
+			t.Errorf("Decode got %+v, want %+v", viaMgo, block)
+		}
+	}
+}
+
+func TestBsonDecodeBlockRejects(t *testing.T) {
+	e := BsonEncoder{}
+	b, _ := e.AppendBlock(nil, &testBlocks[1])
+	notData, _ := e.Encode(&Packet{Type: PING, Payload: 1})
+	for name, data := range map[string][]byte{
+		"empty":     nil,
+		"truncated": b[:len(b)-3],
+		"not data":  notData,
+	} {
+		var block Block
+		if err := e.DecodeBlock(data, &block); err == nil {
+			t.Errorf("%s: DecodeBlock accepted it", name)
+		}
+	}
+}
+
+func TestCopyBlockTooLarge(t *testing.T) {
+	pool := newBufferPool(16, 1)
+	d := copyBlock(Block{Data: make([]byte, 17)}, pool, nil)
+	if d.err != errBlockTooLarge {
+		t.Errorf("got %v, want %v", d.err, errBlockTooLarge)
+	}
+	d = copyBlock(Block{Data: make([]byte, 16)}, pool, nil)
+	if d.err != nil || len(d.block.Data) != 16 {
+		t.Errorf("got %d bytes, %v", len(d.block.Data), d.err)
+	}
+}
+
+func benchmarkEncoders() map[string]Encoder {
+	return map[string]Encoder{"bson": BsonEncoder{}, "gob": NewGobEncoder()}
+}
+
+func BenchmarkAppendBlock(b *testing.B) {
+	for name, e := range benchmarkEncoders() {
+		b.Run(name, func(b *testing.B) {
+			block := Block{Number: 1234, Data: make([]byte, 1400), Type: ORIGINAL}
+			buf := make([]byte, 0, 2048)
+			b.ReportAllocs()
+			b.SetBytes(int64(len(block.Data)))
+			for i := 0; i < b.N; i++ {
+				if _, err := appendBlock(e, buf[:0], &block); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkDecodeBlock(b *testing.B) {
+	for name, e := range benchmarkEncoders() {
+		b.Run(name, func(b *testing.B) {
+			data, err := appendBlock(e, nil, &Block{Number: 1234, Data: make([]byte, 1400), Type: ORIGINAL})
+			if err != nil {
+				b.Fatal(err)
+			}
+			var block Block
+			b.ReportAllocs()
+			b.SetBytes(1400)
+			for i := 0; i < b.N; i++ {
+				if err := decodeBlock(e, data, &block); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package gonami
+
+import (
+	"io"
+	"log"
+	"net"
+	"os"
+	"time"
+)
+
+// copied between progress updates
+const localCopyChunk = 64 << 20
+
+// copyLocally copies src, the server's file, to where the download goes
+// and then lets the server know it's done. os.File copies between files
+// with copy_file_range where there is one, which file systems that can
+// share extents turn into a reflink
+func copyLocally(src *os.File, e Encoder, controlConn net.Conn, t *clientTransfer) {
+	defer src.Close()
+	if err := copyFile(src, t); err != nil {
+		errMsg := "Error copying file: " + err.Error()
+		log.Println(errMsg)
+		t.updateProgress(Progress{Type: ERROR, Message: errMsg, Percentage: 0})
+		//the server is only waiting for DONE
+		controlConn.Close()
+		return
+	}
+	t.updateProgress(Progress{Type: TRANSFERRING, Message: "Finalizing file", Percentage: 1})
+	pkt := Packet{Type: DONE}
+	sendPacket(&pkt, controlConn, e)
+}
+
+func copyFile(src *os.File, t *clientTransfer) error {
+	srcInfo, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	//downloading a file onto itself, there's nothing to do and creating
+	//it would truncate it
+	if dstInfo, err := os.Stat(t.fullPath()); err == nil && os.SameFile(srcInfo, dstInfo) {
+		return nil
+	}
+	fo, err := os.Create(t.fullPath())
+	if err != nil {
+		return err
+	}
+	defer fo.Close()
+	start := time.Now()
+	var copied int64
+	for copied < t.filesize {
+		n, err := io.CopyN(fo, src, min(localCopyChunk, t.filesize-copied))
+		copied += n
+		if err != nil {
+			return err
+		}
+		elapsed := time.Since(start).Seconds()
+		t.updateProgress(Progress{Type: TRANSFERRING, Message: "Copying...", Percentage: float64(copied) / float64(t.filesize),
+			Throughput: float64(copied) / elapsed})
+	}
+	return fo.Sync()
+}
@@ -0,0 +1,299 @@
+package gonami
+
+import (
+	"log"
+	"math"
+	"strconv"
+
+	"github.com/klauspost/reedsolomon"
+	"github.com/willf/bitset"
+)
+
+// maxFECGroups bounds how many incomplete groups the client holds on to
+const maxFECGroups = 32
+
+// fecCodecs caches a Reed-Solomon codec per number of parity shards,
+// since the server can change that number during a transfer
+type fecCodecs struct {
+	dataShards int
+	codecs     map[int]reedsolomon.Encoder
+}
+
+func (c *fecCodecs) get(parity int) (reedsolomon.Encoder, error) {
+	if codec, ok := c.codecs[parity]; ok {
+		return codec, nil
+	}
+	codec, err := reedsolomon.New(c.dataShards, parity)
+	if err != nil {
+		return nil, err
+	}
+	if c.codecs == nil {
+		c.codecs = make(map[int]reedsolomon.Encoder)
+	}
+	c.codecs[parity] = codec
+	return codec, nil
+}
+
+// fecEncoder builds the parity blocks for each group of FECDataShards
+// consecutive blocks of a pass over the file. the blocks of the last
+// group past the end of the file count as zeroes
+type fecEncoder struct {
+	codecs    fecCodecs
+	numBlocks int
+	parity    int
+	minParity int
+	maxParity int
+	group     int
+	have      int
+	shards    [][]byte
+}
+
+func newFECEncoder(c Config, numBlocks int) *fecEncoder {
+	maxParity := c.FECMaxParityShards
+	if maxParity < c.FECParityShards {
+		maxParity = c.FECParityShards
+	}
+	shards := make([][]byte, c.FECDataShards+maxParity)
+	for i := range shards {
+		shards[i] = make([]byte, c.BlockSize)
+	}
+	return &fecEncoder{codecs: fecCodecs{dataShards: c.FECDataShards}, numBlocks: numBlocks,
+		parity:    c.FECParityShards,
+		minParity: c.FECParityShards,
+		maxParity: maxParity,
+		shards:    shards}
+}
+
+// add takes in the next block of the pass, and returns the parity
+// blocks for its group once the group is complete
+func (f *fecEncoder) add(block Block, pool *bufferPool) []Block {
+	k := f.codecs.dataShards
+	g, i := block.Number/k, block.Number%k
+	if g != f.group || i != f.have {
+		//the pass restarted or skipped ahead, pick up again at the
+		//start of the next group
+		f.group = -1
+		if i != 0 {
+			return nil
+		}
+		f.group = g
+		f.have = 0
+	}
+	n := copy(f.shards[i], block.Data)
+	clear(f.shards[i][n:])
+	f.have++
+	if f.have < k && block.Number < f.numBlocks-1 {
+		return nil
+	}
+	for j := f.have; j < k; j++ {
+		clear(f.shards[j])
+	}
+	f.group = g + 1
+	f.have = 0
+	if f.parity < 1 {
+		return nil
+	}
+	codec, err := f.codecs.get(f.parity)
+	if err != nil {
+		log.Println("Error creating FEC codec: " + err.Error())
+		return nil
+	}
+	shards := f.shards[:k+f.parity]
+	if err := codec.Encode(shards); err != nil {
+		log.Println("Error encoding parity: " + err.Error())
+		return nil
+	}
+	parity := make([]Block, f.parity)
+	for j := range parity {
+		data := pool.get()
+		copy(data, shards[k+j])
+		parity[j] = Block{Number: g, Data: data, Type: PARITY, Shard: j, Parity: f.parity}
+	}
+	return parity
+}
+
+// adapt sizes the parity for the loss the client is seeing, aiming for
+// twice the number of blocks a group is expected to lose
+func (f *fecEncoder) adapt(errorRate float64) {
+	parity := int(math.Ceil(2 * errorRate * float64(f.codecs.dataShards)))
+	if parity < f.minParity {
+		parity = f.minParity
+	}
+	if parity > f.maxParity {
+		parity = f.maxParity
+	}
+	f.parity = parity
+}
+
+type fecGroup struct {
+	shards [][]byte //data shards, followed by parity shards
+	parity int
+	have   int
+}
+
+// fecDecoder holds on to the blocks of recent groups, so that missing
+// blocks can be rebuilt once enough parity has come in
+type fecDecoder struct {
+	codecs    fecCodecs
+	numBlocks int
+	maxParity int
+	blockSize int
+	filesize  int64
+	groups    map[int]*fecGroup
+	pool      *bufferPool
+}
+
+func newFECDecoder(c Config, filesize int64, numBlocks int) *fecDecoder {
+	return &fecDecoder{codecs: fecCodecs{dataShards: c.FECDataShards}, numBlocks: numBlocks,
+		maxParity: max(c.FECParityShards, c.FECMaxParityShards),
+		blockSize: c.BlockSize,
+		filesize:  filesize,
+		groups:    make(map[int]*fecGroup),
+		pool:      newBufferPool(c.BlockSize, maxFECGroups*c.FECDataShards)}
+}
+
+// dataIn is the number of real blocks in group g
+func (f *fecDecoder) dataIn(g int) int {
+	k := f.codecs.dataShards
+	n := f.numBlocks - g*k
+	if n > k {
+		return k
+	}
+	return n
+}
+
+// validParity checks a parity block is for a group of the file, with
+// no more parity than we asked for and a shard within it
+func (f *fecDecoder) validParity(block Block) bool {
+	k := f.codecs.dataShards
+	numGroups := (f.numBlocks + k - 1) / k
+	return block.Number >= 0 && block.Number < numGroups && block.Parity >= 1 && block.Parity <= f.maxParity &&
+		block.Shard >= 0 && block.Shard < block.Parity
+}
+
+// group is the group g, which has to be a group of the file
+func (f *fecDecoder) group(g int) *fecGroup {
+	if grp, ok := f.groups[g]; ok {
+		return grp
+	}
+	if len(f.groups) >= maxFECGroups {
+		oldest := -1
+		for og := range f.groups {
+			if oldest == -1 || og < oldest {
+				oldest = og
+			}
+		}
+		f.release(oldest)
+	}
+	k := f.codecs.dataShards
+	grp := &fecGroup{shards: make([][]byte, k)}
+	//the blocks past the end of the file are zeroes
+	for i := f.dataIn(g); i < k; i++ {
+		grp.shards[i] = make([]byte, f.blockSize)
+		grp.have++
+	}
+	f.groups[g] = grp
+	return grp
+}
+
+func (f *fecDecoder) release(g int) {
+	grp, ok := f.groups[g]
+	if !ok {
+		return
+	}
+	for _, shard := range grp.shards {
+		if shard != nil {
+			f.pool.put(shard)
+		}
+	}
+	delete(f.groups, g)
+}
+
+func (f *fecDecoder) addData(block Block) {
+	if block.Number < 0 || block.Number >= f.numBlocks {
+		return
+	}
+	k := f.codecs.dataShards
+	g, i := block.Number/k, block.Number%k
+	grp := f.group(g)
+	if grp.shards[i] != nil {
+		return
+	}
+	shard := f.pool.get()
+	n := copy(shard, block.Data)
+	clear(shard[n:])
+	grp.shards[i] = shard
+	grp.have++
+	if grp.have == k && grp.parity == 0 {
+		//everything came through, the parity won't be needed
+		f.release(g)
+	}
+}
+
+// addParity stores a parity block, and appends any blocks it allows
+// to be rebuilt to recovered. recovered blocks get their data from pool
+func (f *fecDecoder) addParity(block Block, bs *bitset.BitSet, pool *bufferPool, recovered []Block) []Block {
+	//anyone can send to the data ports
+	if !f.validParity(block) {
+		log.Println("Dropping parity block outside the file: group " + strconv.Itoa(block.Number))
+		return recovered
+	}
+	k := f.codecs.dataShards
+	g := block.Number
+	missing := false
+	for b := g * k; b < g*k+f.dataIn(g); b++ {
+		if !bs.Test(uint(b)) {
+			missing = true
+			break
+		}
+	}
+	if !missing {
+		f.release(g)
+		return recovered
+	}
+	grp := f.group(g)
+	if grp.parity == 0 {
+		grp.parity = block.Parity
+		grp.shards = append(grp.shards, make([][]byte, block.Parity)...)
+	}
+	//the parity of a group is fixed when it is sent
+	if block.Parity != grp.parity || grp.shards[k+block.Shard] != nil {
+		return recovered
+	}
+	shard := make([]byte, f.blockSize)
+	copy(shard, block.Data)
+	grp.shards[k+block.Shard] = shard
+	grp.have++
+	if grp.have < k {
+		return recovered
+	}
+	codec, err := f.codecs.get(grp.parity)
+	if err != nil {
+		log.Println("Error creating FEC codec: " + err.Error())
+		return recovered
+	}
+	var rebuilt []int
+	for i := 0; i < k; i++ {
+		if grp.shards[i] == nil {
+			rebuilt = append(rebuilt, i)
+		}
+	}
+	if err := codec.ReconstructData(grp.shards); err != nil {
+		log.Println("Error reconstructing blocks: " + err.Error())
+		return recovered
+	}
+	for _, i := range rebuilt {
+		number := g*k + i
+		data := pool.get()
+		n := copy(data, grp.shards[i])
+		//the last block of the file is usually short
+		if remaining := f.filesize - int64(number)*int64(f.blockSize); remaining < int64(n) {
+			n = int(remaining)
+		}
+		recovered = append(recovered, Block{Number: number, Data: data[:n], Type: RETRANSMITTED})
+	}
+	//the parity shards aren't pooled, only hand back the data shards
+	grp.shards = grp.shards[:k]
+	f.release(g)
+	return recovered
+}
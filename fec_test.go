@@ -0,0 +1,130 @@
+package gonami
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/willf/bitset"
+)
+
+const (
+	fecBlockSize = 100
+	fecShards    = 8
+	fecParity    = 3
+	//five groups, the last of six blocks ending in a short one
+	fecNumBlocks = 38
+	fecFilesize  = fecBlockSize*(fecNumBlocks-1) + 42
+)
+
+func fecConfig() Config {
+	c := NewConfig()
+	c.BlockSize = fecBlockSize
+	c.FECDataShards = fecShards
+	c.FECParityShards = fecParity
+	return c
+}
+
+// fecTransfer sends the blocks of data and their parity through an
+// encoder and decoder, losing the blocks that lost says. it returns
+// what the decoder ended up with, and which blocks it had
+func fecTransfer(t *testing.T, data []byte, lost func(block int) bool) ([]byte, *bitset.BitSet) {
+	c := fecConfig()
+	pool := newBufferPool(c.BlockSize, 10)
+	enc := newFECEncoder(c, fecNumBlocks)
+	dec := newFECDecoder(c, int64(len(data)), fecNumBlocks)
+	bs := bitset.New(fecNumBlocks)
+	got := make([]byte, len(data))
+	for b := 0; b < fecNumBlocks; b++ {
+		block := Block{Number: b, Data: append([]byte{}, data[b*fecBlockSize:min((b+1)*fecBlockSize, len(data))]...), Type: ORIGINAL}
+		parity := enc.add(block, pool)
+		if !lost(b) {
+			dec.addData(block)
+			bs.Set(uint(b))
+			copy(got[b*fecBlockSize:], block.Data)
+		}
+		for _, p := range parity {
+			for _, r := range dec.addParity(p, bs, pool, nil) {
+				if bs.Test(uint(r.Number)) {
+					t.Errorf("block %d rebuilt, but it wasn't lost", r.Number)
+				}
+				if want := min(fecBlockSize, len(data)-r.Number*fecBlockSize); len(r.Data) != want {
+					t.Errorf("block %d rebuilt with %d bytes, want %d", r.Number, len(r.Data), want)
+				}
+				bs.Set(uint(r.Number))
+				copy(got[r.Number*fecBlockSize:], r.Data)
+			}
+		}
+	}
+	return got, bs
+}
+
+func TestFECRebuildsLostBlocks(t *testing.T) {
+	data := make([]byte, fecFilesize)
+	rand.Read(data)
+	for name, lost := range map[string]func(int) bool{
+		"one per group": func(b int) bool { return b%fecShards == 5 },
+		//in the short last group, the short last block among them
+		"parity per group": func(b int) bool { return b%fecShards == 1 || b%fecShards == 4 || b%fecShards == 5 },
+		"end of file":      func(b int) bool { return b >= fecNumBlocks-fecParity },
+	} {
+		got, bs := fecTransfer(t, data, lost)
+		if int(bs.Count()) != fecNumBlocks {
+			t.Errorf("%s: %d of %d blocks", name, bs.Count(), fecNumBlocks)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("%s: rebuilt data differs", name)
+		}
+	}
+}
+
+// TestFECTooManyLost checks a group that lost more than its parity
+// gives up on being rebuilt, leaving the other groups alone
+func TestFECTooManyLost(t *testing.T) {
+	data := make([]byte, fecFilesize)
+	rand.Read(data)
+	tooMany := func(b int) bool { return b/fecShards == 1 && b%fecShards <= fecParity }
+	got, bs := fecTransfer(t, data, func(b int) bool { return tooMany(b) || b == 20 || b == fecNumBlocks-1 })
+	for b := 0; b < fecNumBlocks; b++ {
+		if bs.Test(uint(b)) == tooMany(b) {
+			t.Errorf("block %d: have it %v", b, bs.Test(uint(b)))
+		}
+		if bs.Test(uint(b)) {
+			end := min((b+1)*fecBlockSize, len(data))
+			if !bytes.Equal(got[b*fecBlockSize:end], data[b*fecBlockSize:end]) {
+				t.Errorf("block %d: data differs", b)
+			}
+		}
+	}
+}
+
+// TestFECOutsideFile feeds the decoder blocks that a stray or forged
+// datagram could carry
+func TestFECOutsideFile(t *testing.T) {
+	c := fecConfig()
+	pool := newBufferPool(c.BlockSize, 10)
+	dec := newFECDecoder(c, fecFilesize, fecNumBlocks)
+	bs := bitset.New(fecNumBlocks)
+	for _, number := range []int{-1, -fecShards, fecNumBlocks, 1 << 30} {
+		dec.addData(Block{Number: number, Data: []byte{1}, Type: ORIGINAL})
+	}
+	numGroups := (fecNumBlocks + fecShards - 1) / fecShards
+	for _, block := range []Block{
+		{Number: -1, Shard: 0, Parity: fecParity},
+		{Number: numGroups, Shard: 0, Parity: fecParity},
+		{Number: 1, Shard: -1, Parity: fecParity},
+		{Number: 1, Shard: fecParity, Parity: fecParity},
+		{Number: 1, Shard: 0, Parity: 0},
+		{Number: 1, Shard: 0, Parity: -2},
+		{Number: 1, Shard: 0, Parity: 200},
+		//a valid one, then one whose parity doesn't match its group's
+		{Number: 2, Shard: 0, Parity: fecParity},
+		{Number: 2, Shard: 3, Parity: fecParity + 1},
+	} {
+		block.Type = PARITY
+		block.Data = make([]byte, fecBlockSize)
+		if recovered := dec.addParity(block, bs, pool, nil); len(recovered) != 0 {
+			t.Errorf("%+v rebuilt %d blocks", block, len(recovered))
+		}
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !unix
+
+package gonami
+
+import (
+	"errors"
+	"os"
+)
+
+func fileIdentity(path string) (FileIdentity, error) {
+	return FileIdentity{}, errors.New("Identifying files is not supported on this platform")
+}
+
+func openSameFile(id FileIdentity, path string) *os.File {
+	return nil
+}
@@ -0,0 +1,48 @@
+//go:build unix
+
+package gonami
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileIdentity identifies the file at path, without giving away where
+// it is
+func fileIdentity(path string) (FileIdentity, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return FileIdentity{}, err
+	}
+	return statIdentity(info), nil
+}
+
+func statIdentity(info os.FileInfo) FileIdentity {
+	id := FileIdentity{Size: info.Size(), ModTime: info.ModTime().UnixNano()}
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		id.Device = int64(st.Dev)
+		id.Inode = int64(st.Ino)
+	}
+	return id
+}
+
+// openSameFile opens the file at path when it is the one id is for, the
+// same device, inode, size and modification time, and nil otherwise.
+// device numbers are only stable on one host, so this is for a volume
+// both ends mount there, eg containers sharing a bind mount
+func openSameFile(id FileIdentity, path string) *os.File {
+	//no file has inode 0, the server couldn't identify its own
+	if id.Inode == 0 {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() || statIdentity(info) != id {
+		f.Close()
+		return nil
+	}
+	return f
+}
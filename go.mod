@@ -0,0 +1,18 @@
+module github.com/nstehr/go-nami
+
+go 1.25.0
+
+require (
+	github.com/klauspost/compress v1.18.0
+	github.com/klauspost/reedsolomon v1.10.0
+	github.com/quic-go/quic-go v0.59.1
+	github.com/willf/bitset v1.1.11
+	golang.org/x/net v0.57.0
+	golang.org/x/sys v0.47.0
+	gopkg.in/mgo.v2 v2.0.0-20190816093944-a6b53ec6cb22
+)
+
+require (
+	github.com/klauspost/cpuid/v2 v2.4.0 // indirect
+	golang.org/x/crypto v0.54.0 // indirect
+)
@@ -11,6 +11,11 @@ func NewGobEncoder() GobEncoder {
 	gob.Register(Config{})
 	gob.Register(Block{})
 	gob.Register(Retransmit{})
+	gob.Register(DataPorts{})
+	gob.Register(PathErrorRates{})
+	gob.Register(PathParams{})
+	gob.Register(FileIdentity{})
+	gob.Register(PathChallenge{})
 	return GobEncoder{}
 }
 
@@ -10,6 +10,17 @@ const (
 	RETRANSMIT
 	ERROR_RATE
 	DONE
+	PING
+	PONG
+	END_OF_PASS
+	MTU_PROBE
+	DATA_PORTS
+	ERROR_RATES
+	PUNCH
+	PATH_PARAMS
+	FILE_IDENTITY
+	PATH_CHALLENGE
+	TRANSFER_ERROR //the transfer can't go on, the payload says why
 )
 
 type Packet struct {
@@ -22,15 +33,71 @@ type BlockType int
 const (
 	ORIGINAL BlockType = iota
 	RETRANSMITTED
+	PARITY
 )
 
+// Block is a piece of the file. for PARITY blocks, Number is the FEC
+// group, Shard which of its Parity parity blocks this is. Compressed
+// blocks need decompressing before they can be used. when there are
+// several data streams, Seq numbers the packets sent on each
 type Block struct {
-	Number int
-	Data   []byte
-	Type   BlockType
+	Number     int
+	Data       []byte
+	Type       BlockType
+	Shard      int  `bson:",omitempty"`
+	Parity     int  `bson:",omitempty"`
+	Compressed bool `bson:",omitempty"`
+	Seq        int  `bson:",omitempty"`
 }
 
+// Retransmit carries the missing blocks as run length encoded ranges
+// relative to Base, see encodeRanges. for a restart, Base is the block
+// to restart from
 type Retransmit struct {
 	IsRestart bool
-	BlockNums []int
+	Base      int
+	Ranges    []byte
+}
+
+// DataPorts lists the ports the client is listening on for data, one
+// per data stream. Hosts holds the address to send each port's data
+// to, an empty string meaning the address of the control connection.
+// a server's ports come with a random Token, which the client's punches
+// have to carry
+type DataPorts struct {
+	Ports []int
+	Hosts []string
+	Token []byte
+}
+
+// PathChallenge lists the data streams going to a host other than the
+// client's control connection. the server sends a nonce down each of
+// them, and the client echoes back the Nonces it received, in the same
+// order, before any data is sent
+type PathChallenge struct {
+	Streams []int
+	Nonces  [][]byte
+}
+
+// PathErrorRates has the error rate seen on each data stream, in the
+// order of DataPorts
+type PathErrorRates struct {
+	Rates []float64
+}
+
+// FileIdentity is the file as the server sees it, for a client to check
+// the file it finds under Client.ServerDirectory is the very same one.
+// all zero means the server can't tell
+type FileIdentity struct {
+	Device  int64
+	Inode   int64
+	Size    int64
+	ModTime int64
+}
+
+// PathParams is how the server settles on sending the data, once it
+// knows what made it down the data paths
+type PathParams struct {
+	BlockSize int
+	Transport TransportType
 }
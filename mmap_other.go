@@ -0,0 +1,14 @@
+//go:build !unix
+
+package gonami
+
+import (
+	"errors"
+	"os"
+)
+
+func mmapFile(file *os.File, size int64) ([]byte, error) {
+	return nil, errors.New("mmap is not supported on this platform")
+}
+
+func munmapFile(data []byte) {}
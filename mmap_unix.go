@@ -0,0 +1,21 @@
+//go:build unix
+
+package gonami
+
+import (
+	"os"
+	"syscall"
+)
+
+func mmapFile(file *os.File, size int64) ([]byte, error) {
+	if size == 0 {
+		return []byte{}, nil
+	}
+	return syscall.Mmap(int(file.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+func munmapFile(data []byte) {
+	if len(data) > 0 {
+		syscall.Munmap(data)
+	}
+}
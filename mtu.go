@@ -0,0 +1,168 @@
+package gonami
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"math"
+	"net"
+	"time"
+)
+
+// mtuProbeMagic starts every MTU probe datagram, which is otherwise
+// just padding out to the size being probed
+var mtuProbeMagic = []byte("gonami-mtu-probe")
+
+// the path MTUs worth probing for, largest first. the smallest is
+// there to check UDP gets through at all
+var probeMTUs = []int{9000, 4470, 1500, 1492, 1280, 576}
+
+const (
+	//each probe size is sent this many times, in case of loss
+	probeRepeats = 3
+	//how long the client keeps listening for probes once the server
+	//says it has sent them all
+	probeGrace = 50 * time.Millisecond
+	//the largest probe the client can receive
+	maxProbeSize = 65535
+)
+
+// probeSizes are the sizes of datagram the server probes the paths
+// with. without the DF bit the probes would just be fragmented, so all
+// that is left to check then is that UDP gets through at all
+func probeSizes(c Config) []int {
+	if c.Transport == TCP_TRANSPORT {
+		return nil
+	}
+	if c.PathMTUDiscovery && dontFragmentSupported {
+		return probeMTUs
+	}
+	if c.Transport == AUTO_TRANSPORT {
+		return probeMTUs[len(probeMTUs)-1:]
+	}
+	return nil
+}
+
+// sendMTUProbes sends DF-set datagrams of each of sizes down path, from
+// its data socket. only the ones that fit the path make it to the client
+func sendMTUProbes(path dataPath, sizes []int) error {
+	addr := path.remote()
+	//QUIC keeps DF set on a shared socket for its own probing, and a
+	//single size only checks that UDP gets through
+	if !path.shared && len(sizes) > 1 {
+		if err := setDontFragment(path.conn, addr, true); err != nil {
+			return err
+		}
+		defer setDontFragment(path.conn, addr, false)
+	}
+	//ip and udp headers
+	headers := 28
+	if addr.IP.To4() == nil {
+		headers = 48
+	}
+	probe := make([]byte, sizes[0])
+	copy(probe, mtuProbeMagic)
+	for i := 0; i < probeRepeats; i++ {
+		for _, mtu := range sizes {
+			//probes bigger than the local interface MTU fail straight
+			//away with EMSGSIZE, which is an answer in itself
+			path.write(probe[:mtu-headers])
+		}
+	}
+	return nil
+}
+
+// mtuProbeReader listens for MTU probes on the client's data socket,
+// keeping track of the largest to arrive. proxied probes come wrapped
+// by the proxy's relay
+type mtuProbeReader struct {
+	conn    net.PacketConn
+	proxied bool
+	result  chan int
+}
+
+func newMTUProbeReader(conn net.PacketConn, proxied bool) *mtuProbeReader {
+	r := &mtuProbeReader{conn: conn, proxied: proxied, result: make(chan int, 1)}
+	go r.read()
+	return r
+}
+
+func (r *mtuProbeReader) read() {
+	buf := make([]byte, maxProbeSize)
+	largest := 0
+	for {
+		n, _, err := r.conn.ReadFrom(buf)
+		if err != nil {
+			r.result <- largest
+			return
+		}
+		probe := buf[:n]
+		if r.proxied {
+			probe, _ = socksPayload(probe)
+		}
+		if len(probe) > largest && isMTUProbe(probe) {
+			largest = len(probe)
+		}
+	}
+}
+
+// stop waits out any probes still on their way for up to grace, and
+// returns the size of the largest one received, or 0 if none were
+func (r *mtuProbeReader) stop(grace time.Duration) int {
+	r.conn.SetReadDeadline(time.Now().Add(grace))
+	largest := <-r.result
+	r.conn.SetReadDeadline(time.Time{})
+	return largest
+}
+
+// pathStarts returns the index of the first data stream of each path,
+// given the host of each stream
+func pathStarts(hosts []string) []int {
+	var starts []int
+	for i := range hosts {
+		if i == 0 || hosts[i] != hosts[i-1] {
+			starts = append(starts, i)
+		}
+	}
+	return starts
+}
+
+func isMTUProbe(data []byte) bool {
+	return bytes.HasPrefix(data, mtuProbeMagic)
+}
+
+// blockSizeFor returns the largest block size for which a DATA packet
+// encoded by e fits in a datagram of size bytes
+func blockSizeFor(size int, e Encoder) (int, error) {
+	//the largest values the header can hold, so variable length
+	//encodings come out at their longest
+	block := Block{Number: math.MaxInt, Type: PARITY, Shard: math.MaxInt, Parity: math.MaxInt, Compressed: true, Seq: math.MaxInt}
+	blockSize := size
+	for blockSize > 0 {
+		block.Data = make([]byte, blockSize)
+		b, err := appendBlock(e, nil, &block)
+		if err != nil {
+			return 0, err
+		}
+		if len(b) <= size {
+			return blockSize, nil
+		}
+		blockSize -= len(b) - size
+	}
+	return 0, errors.New("Datagrams too small to carry any data")
+}
+
+// discoveredBlockSize picks the block size for the largest probe the
+// client received, falling back to the configured size
+func discoveredBlockSize(largestProbe int, e Encoder, c Config) int {
+	if largestProbe <= 0 {
+		log.Println("No MTU probes received, using the configured block size")
+		return c.BlockSize
+	}
+	blockSize, err := blockSizeFor(largestProbe, e)
+	if err != nil {
+		log.Println("Error sizing blocks: " + err.Error())
+		return c.BlockSize
+	}
+	return blockSize
+}
@@ -0,0 +1,174 @@
+package gonami
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// pathChallengeMagic starts the datagrams carrying the nonce of a path
+// challenge, see PathChallenge
+var pathChallengeMagic = []byte("\x00gonami-challenge")
+
+const (
+	challengeNonceSize = 8
+	//how often the server sends the nonces until the client answers
+	challengeInterval = 100 * time.Millisecond
+	//how long the client listens for them, and the server sends them
+	challengeTimeout = 2 * time.Second
+)
+
+// localPathIPs finds an address on each local interface that the data
+// could come in on, of the same family as the control connection. the
+// interfaces are network's, when it has any, and nil leaves it to the
+// system. a control connection over loopback only gets loopback paths
+func localPathIPs(controlConn net.Conn, network Network) []net.IP {
+	lister, ok := network.(InterfaceNetwork)
+	if !ok {
+		return nil
+	}
+	local := udpAddr(controlConn.LocalAddr())
+	ipv4 := local.IP.To4() != nil
+	ifaces, err := lister.Interfaces(udpAddr(controlConn.RemoteAddr()).IP)
+	if err != nil {
+		log.Println("Error listing interfaces: " + err.Error())
+		return nil
+	}
+	var ips []net.IP
+	for _, iface := range ifaces {
+		if iface.Loopback != local.IP.IsLoopback() {
+			continue
+		}
+		//one address per interface is enough to use its link
+		for _, ip := range iface.Addrs {
+			if (ip.To4() != nil) != ipv4 || ip.IsLinkLocalUnicast() {
+				continue
+			}
+			ips = append(ips, ip)
+			break
+		}
+	}
+	return ips
+}
+
+// validPathHost checks a path a client asked for data to be sent down
+// is a unicast address
+func validPathHost(host string) bool {
+	ip := net.ParseIP(host)
+	return ip != nil && !ip.IsUnspecified() && !ip.IsMulticast() && !ip.Equal(net.IPv4bcast)
+}
+
+// namesHosts is whether the client gave a host for any of its data
+// streams, in which case the server challenges the paths
+func namesHosts(hosts []string) bool {
+	for _, host := range hosts {
+		if host != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// challengedStreams are the data streams going to a host other than
+// peer, the address of the control connection
+func challengedStreams(paths []dataPath, peer net.IP) []int {
+	var streams []int
+	for i, path := range paths {
+		if !path.remote().IP.Equal(peer) {
+			streams = append(streams, i)
+		}
+	}
+	return streams
+}
+
+// sendChallenges sends each challenged stream its nonce, over and over
+// until stop is closed or the client has had long enough
+func sendChallenges(paths []dataPath, challenge PathChallenge, stop chan bool) {
+	deadline := time.After(challengeTimeout)
+	ticker := time.NewTicker(challengeInterval)
+	defer ticker.Stop()
+	for {
+		for k, i := range challenge.Streams {
+			paths[i].write(append(append([]byte{}, pathChallengeMagic...), challenge.Nonces[k]...))
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		case <-deadline:
+			return
+		}
+	}
+}
+
+// answersChallenge checks the client echoed back the nonce of every
+// challenged stream
+func answersChallenge(reply PathChallenge, challenge PathChallenge) bool {
+	if len(reply.Streams) != len(challenge.Streams) || len(reply.Nonces) != len(challenge.Nonces) {
+		return false
+	}
+	for k := range challenge.Streams {
+		if reply.Streams[k] != challenge.Streams[k] || subtle.ConstantTimeCompare(reply.Nonces[k], challenge.Nonces[k]) != 1 {
+			return false
+		}
+	}
+	return true
+}
+
+// readChallenge waits on conn for the nonce of a path challenge
+func readChallenge(conn net.PacketConn, deadline time.Time) ([]byte, error) {
+	conn.SetReadDeadline(deadline)
+	defer conn.SetReadDeadline(time.Time{})
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return nil, err
+		}
+		if n == len(pathChallengeMagic)+challengeNonceSize && isPathChallenge(buf[:n]) {
+			return append([]byte{}, buf[len(pathChallengeMagic):n]...), nil
+		}
+	}
+}
+
+func isPathChallenge(data []byte) bool {
+	return bytes.HasPrefix(data, pathChallengeMagic)
+}
+
+// streamStats counts the packets that arrive on a data stream, so its
+// loss can be worked out from the gaps in their sequence numbers
+type streamStats struct {
+	received atomic.Int64
+	highest  atomic.Int64
+}
+
+func (s *streamStats) add(seq int) {
+	s.received.Add(1)
+	if int64(seq) > s.highest.Load() {
+		s.highest.Store(int64(seq))
+	}
+}
+
+type streamSample struct {
+	received int64
+	highest  int64
+}
+
+// pathErrorRates works out the fraction of packets lost on each stream
+// since the samples in last, which are updated
+func pathErrorRates(stats []*streamStats, last []streamSample) []float64 {
+	rates := make([]float64, len(stats))
+	for i, s := range stats {
+		now := streamSample{received: s.received.Load(), highest: s.highest.Load()}
+		sent := now.highest - last[i].highest
+		received := now.received - last[i].received
+		if sent > 0 && received < sent {
+			rates[i] = float64(sent-received) / float64(sent)
+		}
+		last[i] = now
+	}
+	return rates
+}
@@ -0,0 +1,62 @@
+package gonami
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+// addrConn is a control connection between local and remote
+type addrConn struct {
+	net.Conn
+	local, remote net.Addr
+}
+
+func (c addrConn) LocalAddr() net.Addr  { return c.local }
+func (c addrConn) RemoteAddr() net.Addr { return c.remote }
+
+// interfaceNetwork is a Network with the interfaces it is given
+type interfaceNetwork struct {
+	systemNetwork
+	ifaces []NetworkInterface
+	remote net.IP
+}
+
+func (n *interfaceNetwork) Interfaces(remote net.IP) ([]NetworkInterface, error) {
+	n.remote = remote
+	return n.ifaces, nil
+}
+
+// plainNetwork can't list its interfaces
+type plainNetwork struct {
+	Network
+}
+
+func TestLocalPathIPs(t *testing.T) {
+	conn := addrConn{local: &net.TCPAddr{IP: net.ParseIP("10.0.0.5"), Port: 4000},
+		remote: &net.TCPAddr{IP: net.ParseIP("10.0.9.9"), Port: 5000}}
+	network := &interfaceNetwork{ifaces: []NetworkInterface{
+		{Name: "lo", Loopback: true, Addrs: []net.IP{net.ParseIP("127.0.0.1")}},
+		{Name: "eth0", Addrs: []net.IP{net.ParseIP("fe80::1"), net.ParseIP("2001:db8::5"), net.ParseIP("10.0.0.5")}},
+		{Name: "eth1", Addrs: []net.IP{net.ParseIP("169.254.3.3"), net.ParseIP("10.1.0.5"), net.ParseIP("10.1.0.6")}},
+		{Name: "eth2", Addrs: []net.IP{net.ParseIP("2001:db8::7")}},
+	}}
+	//one address per interface, of the family of the control connection
+	want := []net.IP{net.ParseIP("10.0.0.5"), net.ParseIP("10.1.0.5")}
+	if got := localPathIPs(conn, network); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if !network.remote.Equal(net.ParseIP("10.0.9.9")) {
+		t.Errorf("interfaces asked for the routes to %v, want the server", network.remote)
+	}
+
+	conn.local = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 4000}
+	want = []net.IP{net.ParseIP("127.0.0.1")}
+	if got := localPathIPs(conn, network); !reflect.DeepEqual(got, want) {
+		t.Errorf("over loopback got %v, want %v", got, want)
+	}
+
+	if got := localPathIPs(conn, plainNetwork{}); got != nil {
+		t.Errorf("a network without interfaces got %v", got)
+	}
+}
@@ -0,0 +1,111 @@
+package gonami
+
+import (
+	"context"
+	"net"
+	"syscall"
+)
+
+// Network opens the connections and sockets of a Client or Server, so
+// that something other than the system's network can take its place,
+// eg to inject faults or run over a userspace IP stack. it must still
+// be an IP network: network and address are as for the net package,
+// data sockets are "udp", and the addresses it hands back must give an
+// IP and port from their String, since the paths are worked out and
+// told to the other end from them.
+// setting socket options, like the DSCP or buffer sizes, is only tried
+// on what the net package hands out, and skipped for anything else.
+// for Multipath it also has to be an InterfaceNetwork
+type Network interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+	Listen(network, address string) (net.Listener, error)
+	ListenPacket(network, address string) (net.PacketConn, error)
+}
+
+// NetworkInterface is an interface that is up, and the addresses on it
+type NetworkInterface struct {
+	Name     string
+	Loopback bool
+	Addrs    []net.IP
+}
+
+// InterfaceNetwork is a Network with interfaces of its own, which
+// Multipath spreads the data over. Interfaces lists the ones with a
+// route to remote. any other Network gets the data down a single path
+type InterfaceNetwork interface {
+	Network
+	Interfaces(remote net.IP) ([]NetworkInterface, error)
+}
+
+// systemNetwork is the Network used when none is given. control is
+// run on each socket before it is bound
+type systemNetwork struct {
+	control func(network, address string, c syscall.RawConn) error
+}
+
+func (n systemNetwork) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	dialer := net.Dialer{Control: n.control}
+	return dialer.DialContext(ctx, network, address)
+}
+
+func (n systemNetwork) Listen(network, address string) (net.Listener, error) {
+	lc := net.ListenConfig{Control: n.control}
+	return lc.Listen(context.Background(), network, address)
+}
+
+func (n systemNetwork) ListenPacket(network, address string) (net.PacketConn, error) {
+	lc := net.ListenConfig{Control: n.control}
+	return lc.ListenPacket(context.Background(), network, address)
+}
+
+// Interfaces leaves out the ones without a route to remote, so that
+// bridges and tunnels that lead elsewhere aren't used. loopback ones
+// are only routed to from loopback
+func (n systemNetwork) Interfaces(remote net.IP) ([]NetworkInterface, error) {
+	var routed map[string]bool
+	if !remote.IsLoopback() {
+		var err error
+		if routed, err = routedInterfaces(remote); err != nil {
+			return nil, err
+		}
+	}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	var up []NetworkInterface
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || (routed != nil && !routed[iface.Name]) {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		ni := NetworkInterface{Name: iface.Name, Loopback: iface.Flags&net.FlagLoopback != 0}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok {
+				ni.Addrs = append(ni.Addrs, ipNet.IP)
+			}
+		}
+		up = append(up, ni)
+	}
+	return up, nil
+}
+
+// orSystem is network, or the system's when it is nil
+func orSystem(network Network) Network {
+	if network == nil {
+		return systemNetwork{}
+	}
+	return network
+}
+
+// packetAddress is the address to bind a data socket to, any when
+// local is nil
+func packetAddress(local *net.UDPAddr) string {
+	if local == nil {
+		return ":0"
+	}
+	return local.String()
+}
@@ -0,0 +1,222 @@
+package gonami
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"time"
+)
+
+// punchMagic starts the datagrams a passive client sends to open up
+// its NAT for the data. the leading zero keeps a QUIC server sharing
+// the port from taking them for its own
+var punchMagic = []byte("\x00gonami-punch")
+
+const (
+	//how often the client punches until the server has heard it
+	punchInterval = 100 * time.Millisecond
+	//how long the server waits to be punched
+	punchTimeout = 10 * time.Second
+	//how often the client punches during the transfer, to keep its
+	//NAT mappings from expiring
+	natKeepalive = 15 * time.Second
+	//of the random token a punch carries after punchMagic, ahead of the
+	//index of the stream
+	punchTokenSize = 8
+)
+
+// dataPath is a socket the server sends a data stream down to addr. a
+// shared socket is the QUIC listener's, and isn't ours to close or
+// change the options of
+type dataPath struct {
+	conn   net.PacketConn
+	addr   net.Addr
+	shared bool
+}
+
+func (p dataPath) remote() *net.UDPAddr {
+	return udpAddr(p.addr)
+}
+
+// write sends b on the unconnected socket, so unlike a connected one
+// any ICMP errors, eg port unreachable once the client has gone, are
+// never reported; a dead client is noticed through the control
+// connection instead
+func (p dataPath) write(b []byte) (int, error) {
+	return p.conn.WriteTo(b, p.addr)
+}
+
+func closePaths(paths []dataPath) {
+	for _, path := range paths {
+		if !path.shared {
+			path.conn.Close()
+		}
+	}
+}
+
+// dialPaths opens a data stream to each of the client's listeners
+func dialPaths(clients []string, binding dataBinding) ([]dataPath, error) {
+	var paths []dataPath
+	for _, client := range clients {
+		addr, err := net.ResolveUDPAddr("udp", client)
+		if err != nil {
+			closePaths(paths)
+			return nil, err
+		}
+		conn, err := binding.sender()
+		if err != nil {
+			closePaths(paths)
+			return nil, err
+		}
+		paths = append(paths, dataPath{conn: conn, addr: addr})
+	}
+	return paths, nil
+}
+
+// acceptPunches opens n sockets for a passive client, tells it their
+// ports, and waits for it to punch each one, which gives away the
+// address its NAT maps the stream to. only punches with the token the
+// client was sent count, so nobody else can have the data sent their
+// way. if the punches don't make it and the data can fall back to TCP,
+// there are just no paths. the sockets are bound to the control
+// connection's address, unless binding has one
+func acceptPunches(conn net.Conn, e Encoder, n int, binding dataBinding, fallback bool) ([]dataPath, error) {
+	if qc, ok := conn.(*quicConn); ok && qc.punches != nil {
+		return acceptSharedPunches(qc, e, n, fallback)
+	}
+	if binding.local == nil {
+		control := udpAddr(conn.LocalAddr())
+		binding.local = &net.UDPAddr{IP: control.IP, Zone: control.Zone}
+	}
+	var paths []dataPath
+	ports := DataPorts{Token: generateRandomBytes()[:punchTokenSize]}
+	for i := 0; i < n; i++ {
+		dataConn, err := binding.listen()
+		if err != nil {
+			closePaths(paths)
+			return nil, err
+		}
+		paths = append(paths, dataPath{conn: dataConn})
+		ports.Ports = append(ports.Ports, udpAddr(dataConn.LocalAddr()).Port)
+	}
+	outPkt := &Packet{Type: DATA_PORTS, Payload: ports}
+	if _, err := sendPacket(outPkt, conn, e); err != nil {
+		closePaths(paths)
+		return nil, err
+	}
+	if err := waitForPunches(paths, ports.Token); err != nil {
+		closePaths(paths)
+		if !fallback {
+			return nil, errors.New("Client did not open the data path: " + err.Error())
+		}
+		log.Println("Client did not open the data path: " + err.Error())
+		paths = nil
+	}
+	outPkt = &Packet{Type: PUNCH}
+	if _, err := sendPacket(outPkt, conn, e); err != nil {
+		closePaths(paths)
+		return nil, err
+	}
+	return paths, nil
+}
+
+// acceptSharedPunches has a passive client punch the port its QUIC
+// control connection came in on, once for each data stream, and sends
+// the data back from there
+func acceptSharedPunches(conn *quicConn, e Encoder, n int, fallback bool) ([]dataPath, error) {
+	token := generateRandomBytes()[:punchTokenSize]
+	punches := conn.punches.wait(token)
+	defer conn.punches.done(token)
+	port := udpAddr(conn.punches.conn.LocalAddr()).Port
+	ports := DataPorts{Token: token}
+	for i := 0; i < n; i++ {
+		ports.Ports = append(ports.Ports, port)
+	}
+	outPkt := &Packet{Type: DATA_PORTS, Payload: ports}
+	if _, err := sendPacket(outPkt, conn, e); err != nil {
+		return nil, err
+	}
+	paths := make([]dataPath, n)
+	timeout := time.After(punchTimeout)
+	for punched := 0; punched < n; {
+		select {
+		case p := <-punches:
+			if p.index < n && paths[p.index].addr == nil {
+				paths[p.index] = dataPath{conn: conn.punches.conn, addr: p.addr, shared: true}
+				punched++
+			}
+		case <-timeout:
+			if !fallback {
+				return nil, errors.New("Client did not open the data path")
+			}
+			log.Println("Client did not open the data path")
+			paths = nil
+			punched = n
+		}
+	}
+	outPkt = &Packet{Type: PUNCH}
+	if _, err := sendPacket(outPkt, conn, e); err != nil {
+		return nil, err
+	}
+	return paths, nil
+}
+
+// waitForPunches fills in the address each of paths was punched from,
+// going by the first punch with token and the path's index
+func waitForPunches(paths []dataPath, token []byte) error {
+	deadline := time.Now().Add(punchTimeout)
+	buf := make([]byte, 1500)
+	for i := range paths {
+		paths[i].conn.SetReadDeadline(deadline)
+		for paths[i].addr == nil {
+			n, addr, err := paths[i].conn.ReadFrom(buf)
+			if err != nil {
+				return err
+			}
+			if bytes.Equal(buf[:n], punchPacket(token, i)) {
+				paths[i].addr = addr
+			}
+		}
+		paths[i].conn.SetReadDeadline(time.Time{})
+	}
+	return nil
+}
+
+// punchPacket is what the client punches the index'th data stream's
+// port with. the token sorts out the transfers sharing a port, and
+// keeps anyone else from punching it
+func punchPacket(token []byte, index int) []byte {
+	b := append(append([]byte{}, punchMagic...), token...)
+	return binary.BigEndian.AppendUint16(b, uint16(index))
+}
+
+// startPunching sends the punches from each of conns to the matching
+// address, quickly until opened is closed, and then every so often to
+// keep the path open until the sockets are closed
+func startPunching(conns []net.PacketConn, addrs []net.Addr, punches [][]byte) chan bool {
+	opened := make(chan bool)
+	go func() {
+		wait := opened
+		ticker := time.NewTicker(punchInterval)
+		defer ticker.Stop()
+		for {
+			for i, conn := range conns {
+				if _, err := conn.WriteTo(punches[i], addrs[i]); err != nil {
+					if !errors.Is(err, net.ErrClosed) {
+						log.Println("Error punching data path: " + err.Error())
+					}
+					return
+				}
+			}
+			select {
+			case <-ticker.C:
+			case <-wait:
+				wait = nil
+				ticker.Reset(natKeepalive)
+			}
+		}
+	}()
+	return opened
+}
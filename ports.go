@@ -0,0 +1,82 @@
+package gonami
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"syscall"
+)
+
+// what windows returns for an address in use, rather than EADDRINUSE
+const wsaeaddrinuse = syscall.Errno(10048)
+
+// dataBinding is where the data sockets on this end are bound, on
+// network. local is the address, nil leaving it to the system. ports
+// come from portMin to portMax, any free one when portMin is 0. a
+// sourcePort other than 0 is shared by everything sent, instead
+type dataBinding struct {
+	network    Network
+	local      *net.UDPAddr
+	portMin    int
+	portMax    int
+	sourcePort int
+}
+
+// listen opens a socket on the next free port of the range
+func (b dataBinding) listen() (net.PacketConn, error) {
+	return b.bind(func(local *net.UDPAddr) (net.PacketConn, error) {
+		return b.network.ListenPacket("udp", packetAddress(local))
+	})
+}
+
+// sender opens a socket to send a data stream from, on the source port
+// or the next free port of the range
+func (b dataBinding) sender() (net.PacketConn, error) {
+	if b.sourcePort == 0 {
+		return b.listen()
+	}
+	network := b.network
+	//only the system's sockets can be made to share a port, anything
+	//else has to manage on its own
+	if _, ok := network.(systemNetwork); ok {
+		network = systemNetwork{control: reusePort}
+	}
+	return network.ListenPacket("udp", packetAddress(b.address(b.sourcePort)))
+}
+
+func (b dataBinding) bind(open func(local *net.UDPAddr) (net.PacketConn, error)) (net.PacketConn, error) {
+	if b.portMin == 0 {
+		return open(b.local)
+	}
+	portMax := b.portMax
+	if portMax < b.portMin {
+		portMax = b.portMin
+	}
+	//the first port that isn't taken, by another transfer or anything
+	//else. any other error is the same whatever the port
+	var err error
+	for port := b.portMin; port <= portMax; port++ {
+		var conn net.PacketConn
+		conn, err = open(b.address(port))
+		if err == nil {
+			return conn, nil
+		}
+		if !addrInUse(err) {
+			return nil, err
+		}
+	}
+	return nil, errors.New("No free UDP port from " + strconv.Itoa(b.portMin) + " to " + strconv.Itoa(portMax) + ", other transfers may be using them all: " + err.Error())
+}
+
+func (b dataBinding) address(port int) *net.UDPAddr {
+	addr := net.UDPAddr{Port: port}
+	if b.local != nil {
+		addr.IP = b.local.IP
+		addr.Zone = b.local.Zone
+	}
+	return &addr
+}
+
+func addrInUse(err error) bool {
+	return errors.Is(err, syscall.EADDRINUSE) || errors.Is(err, wsaeaddrinuse)
+}
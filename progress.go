@@ -0,0 +1,154 @@
+package gonami
+
+import (
+	"sync"
+	"time"
+)
+
+// how long closing waits for the consumer to take the updates still
+// pending, before dropping all but the one saying how the transfer ended
+var progressDrainTimeout = 5 * time.Second
+
+// progressRelay delivers progress to a consumer without ever blocking
+// the transfer. TRANSFERRING updates are coalesced, so that only the
+// latest one is delivered, at most once per interval. every other kind
+// of update is queued, and is delivered in order
+type progressRelay struct {
+	ch       chan Progress
+	interval time.Duration
+
+	mu        sync.Mutex
+	events    []Progress
+	latest    Progress
+	hasLatest bool
+	closed    bool
+
+	wake    chan bool
+	abandon chan bool
+	done    chan bool
+}
+
+func newProgressRelay(ch chan Progress, interval time.Duration) *progressRelay {
+	r := &progressRelay{ch: ch, interval: interval, wake: make(chan bool, 1), abandon: make(chan bool),
+		done: make(chan bool)}
+	go r.run()
+	return r
+}
+
+func (r *progressRelay) update(p Progress) {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return
+	}
+	if p.Type == TRANSFERRING {
+		r.latest = p
+		r.hasLatest = true
+	} else {
+		//keep the ordering with any pending TRANSFERRING update
+		if r.hasLatest {
+			r.events = append(r.events, r.latest)
+			r.hasLatest = false
+		}
+		r.events = append(r.events, p)
+	}
+	r.mu.Unlock()
+	select {
+	case r.wake <- true:
+	default:
+	}
+}
+
+// close delivers whatever is still pending, then closes the channel.
+// a consumer that isn't reading doesn't hold up the transfer: what is
+// left is dropped, except for the final ERROR or TRANSFER_DONE, which
+// is still handed over whenever it reads
+func (r *progressRelay) close() {
+	r.mu.Lock()
+	r.closed = true
+	r.mu.Unlock()
+	select {
+	case r.wake <- true:
+	default:
+	}
+	select {
+	case <-r.done:
+	case <-time.After(progressDrainTimeout):
+		close(r.abandon)
+	}
+}
+
+func (r *progressRelay) run() {
+	defer close(r.done)
+	defer close(r.ch)
+	var lastSent time.Time
+	for {
+		<-r.wake
+		for {
+			r.mu.Lock()
+			events := r.events
+			r.events = nil
+			closed := r.closed
+			var latest Progress
+			sendLatest := r.hasLatest && (closed || time.Since(lastSent) >= r.interval)
+			if sendLatest {
+				latest = r.latest
+				r.hasLatest = false
+			}
+			pending := r.hasLatest
+			r.mu.Unlock()
+
+			for i, p := range events {
+				if !r.send(p) {
+					r.sendEnd(events[i:])
+					return
+				}
+			}
+			if sendLatest {
+				if !r.send(latest) {
+					r.sendEnd(nil)
+					return
+				}
+				lastSent = time.Now()
+			}
+			if closed {
+				return
+			}
+			if !pending {
+				break
+			}
+			//hold the coalesced update back until the interval is up,
+			//unless something more urgent comes along first
+			select {
+			case <-r.wake:
+			case <-time.After(r.interval - time.Since(lastSent)):
+			}
+		}
+	}
+}
+
+// sendEnd delivers the last update that ends the transfer, out of
+// unsent and whatever is still queued, once close has given up on the
+// consumer taking the rest
+func (r *progressRelay) sendEnd(unsent []Progress) {
+	r.mu.Lock()
+	unsent = append(unsent, r.events...)
+	r.events = nil
+	r.mu.Unlock()
+	for i := len(unsent) - 1; i >= 0; i-- {
+		if unsent[i].Type == ERROR || unsent[i].Type == TRANSFER_DONE {
+			r.ch <- unsent[i]
+			return
+		}
+	}
+}
+
+// send delivers p, unless close has given up on the consumer
+func (r *progressRelay) send(p Progress) bool {
+	select {
+	case r.ch <- p:
+		return true
+	case <-r.abandon:
+		return false
+	}
+}
@@ -0,0 +1,88 @@
+package gonami
+
+import (
+	"testing"
+	"time"
+)
+
+// collectProgress reads ch until it is closed
+func collectProgress(ch chan Progress) chan []Progress {
+	out := make(chan []Progress, 1)
+	go func() {
+		var ps []Progress
+		for p := range ch {
+			ps = append(ps, p)
+		}
+		out <- ps
+	}()
+	return out
+}
+
+func TestProgressRelayKeepsLatest(t *testing.T) {
+	ch := make(chan Progress)
+	//nothing but the first update and the one pending at close gets
+	//through an interval this long
+	r := newProgressRelay(ch, time.Hour)
+	for i := 1; i <= 100; i++ {
+		r.update(Progress{Type: TRANSFERRING, Percentage: float64(i) / 100})
+	}
+	got := collectProgress(ch)
+	r.close()
+	ps := <-got
+	if len(ps) == 0 || len(ps) > 2 {
+		t.Fatalf("got %d updates, want 1 or 2", len(ps))
+	}
+	if last := ps[len(ps)-1]; last.Percentage != 1 {
+		t.Errorf("last update at %v, want 1", last.Percentage)
+	}
+}
+
+func TestProgressRelayOrder(t *testing.T) {
+	ch := make(chan Progress)
+	r := newProgressRelay(ch, time.Hour)
+	got := collectProgress(ch)
+	r.update(Progress{Type: HANDSHAKING, Message: "a"})
+	r.update(Progress{Type: TRANSFERRING, Message: "b"})
+	r.update(Progress{Type: TRANSFERRING, Message: "c"})
+	r.update(Progress{Type: WARNING, Message: "d"})
+	r.update(Progress{Type: TRANSFERRING, Message: "e"})
+	r.update(Progress{Type: TRANSFER_DONE, Message: "f"})
+	r.close()
+	var messages string
+	for _, p := range <-got {
+		messages += p.Message
+	}
+	//b may or may not have been sent before c replaced it
+	if messages != "acdef" && messages != "abcdef" {
+		t.Errorf("got %q, want acdef", messages)
+	}
+}
+
+// TestProgressRelayDeliversEnd checks that a consumer which stops
+// reading doesn't hold up close, and still gets the final update
+func TestProgressRelayDeliversEnd(t *testing.T) {
+	defer func(timeout time.Duration) { progressDrainTimeout = timeout }(progressDrainTimeout)
+	progressDrainTimeout = 50 * time.Millisecond
+	for _, end := range []ProgressType{ERROR, TRANSFER_DONE} {
+		ch := make(chan Progress)
+		r := newProgressRelay(ch, 0)
+		r.update(Progress{Type: TRANSFERRING, Message: "a"})
+		r.update(Progress{Type: WARNING, Message: "b"})
+		r.update(Progress{Type: end, Message: "c"})
+		r.update(Progress{Type: WARNING, Message: "d"})
+		closed := make(chan bool)
+		go func() {
+			r.close()
+			close(closed)
+		}()
+		select {
+		case <-closed:
+		case <-time.After(time.Second):
+			t.Fatal("close waited on the consumer")
+		}
+		ps := <-collectProgress(ch)
+		if len(ps) != 1 || ps[0].Type != end || ps[0].Message != "c" {
+			t.Errorf("got %+v, want just the final %v", ps, end)
+		}
+	}
+}
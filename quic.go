@@ -0,0 +1,391 @@
+package gonami
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+const (
+	quicALPN = "gonami"
+	//how long the client waits for the QUIC handshake
+	quicDialTimeout = 10 * time.Second
+	quicKeepAlive   = 5 * time.Second
+	quicIdleTimeout = 30 * time.Second
+	//how long the server waits for the client to hang up, so that what
+	//it sent last isn't cut off by closing the connection
+	quicLinger = 5 * time.Second
+)
+
+// controlStream is which of the QUIC streams a packet goes out on.
+// everything the state machines rely on the order of, like DATA ahead
+// of END_OF_PASS and DONE, shares the main stream. telemetry goes on its
+// own, so a lost packet there doesn't hold up the rest or the RTT
+type controlStream int
+
+const (
+	mainStream controlStream = iota
+	telemetryStream
+	numControlStreams
+)
+
+func streamFor(t MessageType) controlStream {
+	switch t {
+	case ERROR_RATE, ERROR_RATES, PING, PONG:
+		return telemetryStream
+	}
+	return mainStream
+}
+
+// streamConn is a control connection that can send each kind of packet
+// on its own stream
+type streamConn interface {
+	writeOn(stream controlStream, b []byte) (int, error)
+}
+
+// writeControl writes a framed packet of type t to conn, on its own
+// stream if conn has them
+func writeControl(conn net.Conn, t MessageType, b []byte) (int, error) {
+	if sc, ok := conn.(streamConn); ok {
+		return sc.writeOn(streamFor(t), b)
+	}
+	return conn.Write(b)
+}
+
+// quicConn is a control connection over QUIC. each end sends on its own
+// unidirectional streams, and the packets coming in on all of them are
+// read back one after the other, as from a single stream. packets on
+// the same stream stay in order
+type quicConn struct {
+	conn *quic.Conn
+	//the client's socket, which it owns, nil on the server
+	udp net.PacketConn
+	tr  *quic.Transport
+	//where local addresses are unspecified, the one used to reach the
+	//other end
+	local net.Addr
+	//the server's socket, when passive clients punch it for the data
+	punches *punchRouter
+	linger  bool
+	streams [numControlStreams]*quic.SendStream
+	locks   [numControlStreams]sync.Mutex
+	frames  chan []byte
+	frame   []byte
+	closed  sync.Once
+}
+
+func newQUICConn(conn *quic.Conn, udp net.PacketConn, tr *quic.Transport, linger bool, punches *punchRouter, network Network) *quicConn {
+	c := &quicConn{conn: conn, udp: udp, tr: tr, local: conn.LocalAddr(), punches: punches, linger: linger,
+		frames: make(chan []byte, 64)}
+	local := udpAddr(conn.LocalAddr())
+	if local.IP == nil || local.IP.IsUnspecified() {
+		if ip := routedIP(network, udpAddr(conn.RemoteAddr())); ip != nil {
+			c.local = &net.UDPAddr{IP: ip, Port: local.Port}
+		}
+	}
+	go c.acceptStreams()
+	return c
+}
+
+// routedIP is the local address network would send to remote from
+func routedIP(network Network, remote *net.UDPAddr) net.IP {
+	//nothing is sent by connecting a UDP socket
+	conn, err := network.DialContext(context.Background(), "udp", remote.String())
+	if err != nil {
+		return nil
+	}
+	defer conn.Close()
+	return udpAddr(conn.LocalAddr()).IP
+}
+
+func (c *quicConn) acceptStreams() {
+	for {
+		s, err := c.conn.AcceptUniStream(context.Background())
+		if err != nil {
+			return
+		}
+		go c.readStream(s)
+	}
+}
+
+// readStream passes on each framed packet on s whole, so that packets
+// from different streams don't interleave
+func (c *quicConn) readStream(s *quic.ReceiveStream) {
+	r := bufio.NewReader(s)
+	for {
+		b, err := readFrame(r, nil)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				s.CancelRead(0)
+			}
+			return
+		}
+		frame := make([]byte, 4, 4+len(b))
+		binary.BigEndian.PutUint32(frame, uint32(len(b)))
+		select {
+		case c.frames <- append(frame, b...):
+		case <-c.conn.Context().Done():
+			return
+		}
+	}
+}
+
+func (c *quicConn) Read(p []byte) (int, error) {
+	for len(c.frame) == 0 {
+		//what has come in is read before the connection going away
+		select {
+		case c.frame = <-c.frames:
+			continue
+		default:
+		}
+		select {
+		case c.frame = <-c.frames:
+		case <-c.conn.Context().Done():
+			return 0, io.EOF
+		}
+	}
+	n := copy(p, c.frame)
+	c.frame = c.frame[n:]
+	return n, nil
+}
+
+func (c *quicConn) Write(b []byte) (int, error) {
+	return c.writeOn(mainStream, b)
+}
+
+// writeOn writes b to the stream, opening it the first time. b has to
+// be whole packets
+func (c *quicConn) writeOn(stream controlStream, b []byte) (int, error) {
+	c.locks[stream].Lock()
+	defer c.locks[stream].Unlock()
+	if c.streams[stream] == nil {
+		s, err := c.conn.OpenUniStreamSync(c.conn.Context())
+		if err != nil {
+			return 0, err
+		}
+		c.streams[stream] = s
+	}
+	return c.streams[stream].Write(b)
+}
+
+// Close ends the streams. the server leaves it to the client to close
+// the connection, or gives up waiting after a while
+func (c *quicConn) Close() error {
+	c.closed.Do(func() {
+		for i := range c.streams {
+			c.locks[i].Lock()
+			if c.streams[i] != nil {
+				c.streams[i].Close()
+			}
+			c.locks[i].Unlock()
+		}
+		if c.linger {
+			select {
+			case <-c.conn.Context().Done():
+			case <-time.After(quicLinger):
+			}
+		}
+		c.conn.CloseWithError(0, "")
+		if c.tr != nil {
+			c.tr.Close()
+			c.udp.Close()
+		}
+	})
+	return nil
+}
+
+func (c *quicConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *quicConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// the control connection is never read or written with a deadline
+func (c *quicConn) SetDeadline(t time.Time) error {
+	return errors.New("Deadlines are not supported over QUIC")
+}
+
+func (c *quicConn) SetReadDeadline(t time.Time) error {
+	return c.SetDeadline(t)
+}
+
+func (c *quicConn) SetWriteDeadline(t time.Time) error {
+	return c.SetDeadline(t)
+}
+
+func quicConfig() *quic.Config {
+	return &quic.Config{KeepAlivePeriod: quicKeepAlive, MaxIdleTimeout: quicIdleTimeout}
+}
+
+// dialQUIC opens a control connection to addr over QUIC, from a socket
+// of its own on network. the server's certificate is verified with
+// tlsConf, pinned to fingerprint, or both. with neither, anyone in the
+// way could stand in for the server, so it is refused
+func dialQUIC(network Network, addr string, tlsConf *tls.Config, fingerprint string, dscp int) (net.Conn, error) {
+	if tlsConf == nil && fingerprint == "" {
+		return nil, errors.New("QUIC needs a TLSConfig or the fingerprint of the server's certificate")
+	}
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	//not bound to an address, so the connection can move over to
+	//another one when ours changes
+	udpConn, err := network.ListenPacket("udp", packetAddress(nil))
+	if err != nil {
+		return nil, err
+	}
+	if dscp != 0 {
+		if err := setDSCP(udpConn, raddr.IP, dscp); err != nil {
+			log.Println("Error marking control connection: " + err.Error())
+		}
+	}
+	if tlsConf == nil {
+		//the pin stands in for the chain of trust
+		tlsConf = &tls.Config{InsecureSkipVerify: true}
+	} else {
+		tlsConf = tlsConf.Clone()
+	}
+	if fingerprint != "" {
+		tlsConf.VerifyPeerCertificate = pinCertificate(fingerprint)
+	}
+	if tlsConf.ServerName == "" {
+		tlsConf.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+	tlsConf.NextProtos = []string{quicALPN}
+	tr := &quic.Transport{Conn: udpConn}
+	ctx, cancel := context.WithTimeout(context.Background(), quicDialTimeout)
+	defer cancel()
+	conn, err := tr.Dial(ctx, raddr, tlsConf, quicConfig())
+	if err != nil {
+		tr.Close()
+		udpConn.Close()
+		return nil, err
+	}
+	return newQUICConn(conn, udpConn, tr, false, nil, network), nil
+}
+
+// certFingerprint is the hex SHA-256 of a DER encoded certificate
+func certFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+// pinCertificate checks the server's certificate has fingerprint,
+// written in hex with or without colons
+func pinCertificate(fingerprint string) func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	want := strings.ToLower(strings.ReplaceAll(fingerprint, ":", ""))
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 || subtle.ConstantTimeCompare([]byte(certFingerprint(rawCerts[0])), []byte(want)) != 1 {
+			return errors.New("Server's certificate doesn't match the fingerprint")
+		}
+		return nil
+	}
+}
+
+// selfSignedTLSConfig is used by a QUIC server that wasn't given a
+// certificate. clients pin it by the fingerprint it is logged with
+func selfSignedTLSConfig() (*tls.Config, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "gonami"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	cert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	log.Println("QUIC certificate fingerprint: " + certFingerprint(der))
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+}
+
+// punch is where a passive client's punch for one of its data streams
+// came from
+type punch struct {
+	index int
+	addr  *net.UDPAddr
+}
+
+// punchRouter hands the punches that come in on the server's QUIC
+// socket to the transfers waiting on them, by their token. the data is
+// then sent from that socket as well
+type punchRouter struct {
+	conn    net.PacketConn
+	mu      sync.Mutex
+	waiting map[string]chan punch
+}
+
+func newPunchRouter(conn net.PacketConn) *punchRouter {
+	return &punchRouter{conn: conn, waiting: make(map[string]chan punch)}
+}
+
+func (r *punchRouter) run(tr *quic.Transport) {
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := tr.ReadNonQUICPacket(context.Background(), buf)
+		if err != nil {
+			return
+		}
+		b := buf[:n]
+		if !bytes.HasPrefix(b, punchMagic) || len(b) < len(punchMagic)+punchTokenSize+2 {
+			continue
+		}
+		token := string(b[len(punchMagic) : len(punchMagic)+punchTokenSize])
+		index := int(binary.BigEndian.Uint16(b[len(punchMagic)+punchTokenSize:]))
+		r.mu.Lock()
+		ch := r.waiting[token]
+		r.mu.Unlock()
+		if ch == nil {
+			continue
+		}
+		//the client keeps punching, so one dropped here is sent again
+		select {
+		case ch <- punch{index: index, addr: udpAddr(addr)}:
+		default:
+		}
+	}
+}
+
+func (r *punchRouter) wait(token []byte) chan punch {
+	ch := make(chan punch, 16)
+	r.mu.Lock()
+	r.waiting[string(token)] = ch
+	r.mu.Unlock()
+	return ch
+}
+
+func (r *punchRouter) done(token []byte) {
+	r.mu.Lock()
+	delete(r.waiting, string(token))
+	r.mu.Unlock()
+}
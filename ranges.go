@@ -0,0 +1,144 @@
+package gonami
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"sort"
+
+	"github.com/willf/bitset"
+)
+
+var errBadRanges = errors.New("Malformed block ranges")
+
+// blockRange is the half open range of blocks [start, end)
+type blockRange struct {
+	start int
+	end   int
+}
+
+// rangeList is a sorted list of disjoint, non adjacent block ranges
+type rangeList []blockRange
+
+// insert adds the blocks [start, end), merging with any ranges they
+// touch. gaps are usually found in order, so that case is cheap
+func (l rangeList) insert(start int, end int) rangeList {
+	if start >= end {
+		return l
+	}
+	n := len(l)
+	if n == 0 || l[n-1].end < start {
+		return append(l, blockRange{start, end})
+	}
+	//first range that could touch the new one
+	i := sort.Search(n, func(i int) bool { return l[i].end >= start })
+	j := i
+	for j < n && l[j].start <= end {
+		if l[j].start < start {
+			start = l[j].start
+		}
+		if l[j].end > end {
+			end = l[j].end
+		}
+		j++
+	}
+	if i == j {
+		l = append(l, blockRange{})
+		copy(l[i+1:], l[i:])
+		l[i] = blockRange{start, end}
+		return l
+	}
+	l[i] = blockRange{start, end}
+	return append(l[:i+1], l[j:]...)
+}
+
+// missing returns the parts of l that aren't set in bs
+func (l rangeList) missing(bs *bitset.BitSet) rangeList {
+	var m rangeList
+	for _, r := range l {
+		for b := r.start; b < r.end; {
+			next, ok := bs.NextClear(uint(b))
+			if !ok || int(next) >= r.end {
+				break
+			}
+			end, ok := bs.NextSet(next)
+			if !ok || int(end) > r.end {
+				end = uint(r.end)
+			}
+			m = append(m, blockRange{int(next), int(end)})
+			b = int(end)
+		}
+	}
+	return m
+}
+
+// encodeRanges packs l as uvarint (gap, length) pairs, each gap being
+// counted from the end of the previous range, the first from base.
+// a few bytes are enough for a range of any size
+func encodeRanges(l rangeList) (int, []byte) {
+	if len(l) == 0 {
+		return 0, nil
+	}
+	base := l[0].start
+	data := make([]byte, 0, len(l)*4)
+	prev := base
+	for _, r := range l {
+		data = binary.AppendUvarint(data, uint64(r.start-prev))
+		data = binary.AppendUvarint(data, uint64(r.end-r.start))
+		prev = r.end
+	}
+	return base, data
+}
+
+// decodeRanges unpacks the ranges encodeRanges packed. data that is
+// cut short, or ranges past the largest block number there could be,
+// are an error
+func decodeRanges(base int, data []byte) (rangeList, error) {
+	if base < 0 {
+		return nil, errBadRanges
+	}
+	var l rangeList
+	prev := base
+	for len(data) > 0 {
+		gap, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil, errBadRanges
+		}
+		data = data[n:]
+		length, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil, errBadRanges
+		}
+		data = data[n:]
+		if gap > uint64(math.MaxInt-prev) {
+			return nil, errBadRanges
+		}
+		start := prev + int(gap)
+		if length > uint64(math.MaxInt-start) {
+			return nil, errBadRanges
+		}
+		l = append(l, blockRange{start, start + int(length)})
+		prev = start + int(length)
+	}
+	return l, nil
+}
+
+// truncate drops every block from block onwards
+func (l rangeList) truncate(block int) rangeList {
+	i := sort.Search(len(l), func(i int) bool { return l[i].end > block })
+	if i < len(l) && l[i].start < block {
+		l[i].end = block
+		i++
+	}
+	return l[:i]
+}
+
+// from returns a copy of the blocks from block onwards
+func (l rangeList) from(block int) rangeList {
+	i := sort.Search(len(l), func(i int) bool { return l[i].end > block })
+	l = append(rangeList(nil), l[i:]...)
+	if len(l) > 0 && l[0].start < block {
+		l[0].start = block
+	}
+	return l
+}
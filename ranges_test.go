@@ -0,0 +1,58 @@
+package gonami
+
+import (
+	"encoding/binary"
+	"math"
+	"reflect"
+	"testing"
+)
+
+// TestRangesRoundTrip checks that block ranges come back from their
+// uvarint (gap, length) encoding as they went in
+func TestRangesRoundTrip(t *testing.T) {
+	const numBlocks = 1000
+	for _, test := range []struct {
+		name   string
+		ranges rangeList
+	}{
+		{"empty", nil},
+		{"single block", rangeList{{5, 6}}},
+		{"from block 0", rangeList{{0, 3}, {10, 11}}},
+		{"adjacent", rangeList{{10, 20}, {20, 30}}},
+		{"ends at last block", rangeList{{3, 4}, {990, numBlocks}}},
+		{"whole file", rangeList{{0, numBlocks}}},
+		{"wide gaps", rangeList{{1, 2}, {500, 501}, {999, numBlocks}}},
+	} {
+		base, data := encodeRanges(test.ranges)
+		decoded, err := decodeRanges(base, data)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(decoded, test.ranges) {
+			t.Errorf("%s: got %v, want %v", test.name, decoded, test.ranges)
+		}
+	}
+}
+
+func TestDecodeRangesRejects(t *testing.T) {
+	_, good := encodeRanges(rangeList{{10, 20}, {30, 40}})
+	huge := binary.AppendUvarint(nil, math.MaxUint64)
+	for _, test := range []struct {
+		name string
+		base int
+		data []byte
+	}{
+		{"negative base", -3, good},
+		{"truncated pair", 10, good[:len(good)-1]},
+		{"gap only", 10, good[:1]},
+		{"unterminated uvarint", 10, []byte{0x80}},
+		{"garbage", 0, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{"gap overflows", 10, append(append([]byte{}, huge...), 1)},
+		{"length overflows", 10, append([]byte{0}, huge...)},
+	} {
+		if l, err := decodeRanges(test.base, test.data); err == nil {
+			t.Errorf("%s: decodeRanges accepted it as %v", test.name, l)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+//go:build linux
+
+package gonami
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	rtfUp     = 0x0001
+	rtfReject = 0x0200
+)
+
+// routedInterfaces returns the names of the interfaces that the main
+// routing table has a route to ip through
+func routedInterfaces(ip net.IP) (map[string]bool, error) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return readRoutes("/proc/net/route", func(fields []string) (string, bool) {
+			//Iface Destination Gateway Flags RefCnt Use Metric Mask ...
+			if len(fields) < 8 {
+				return "", false
+			}
+			dest, err1 := strconv.ParseUint(fields[1], 16, 32)
+			flags, err2 := strconv.ParseUint(fields[3], 16, 32)
+			mask, err3 := strconv.ParseUint(fields[7], 16, 32)
+			if err1 != nil || err2 != nil || err3 != nil || !usableRoute(flags) {
+				return "", false
+			}
+			//the kernel writes the addresses out in its own byte order
+			addr := binary.BigEndian.Uint32(ip4)
+			dest = uint64(binary.BigEndian.Uint32(binary.NativeEndian.AppendUint32(nil, uint32(dest))))
+			mask = uint64(binary.BigEndian.Uint32(binary.NativeEndian.AppendUint32(nil, uint32(mask))))
+			return fields[0], uint64(addr)&mask == dest
+		})
+	}
+	return readRoutes("/proc/net/ipv6_route", func(fields []string) (string, bool) {
+		//dest prefix src prefix nexthop metric refcnt use flags iface
+		if len(fields) < 10 {
+			return "", false
+		}
+		dest, err1 := hex.DecodeString(fields[0])
+		prefix, err2 := strconv.ParseUint(fields[1], 16, 8)
+		flags, err3 := strconv.ParseUint(fields[8], 16, 32)
+		if err1 != nil || err2 != nil || err3 != nil || len(dest) != net.IPv6len || prefix > 128 || !usableRoute(flags) {
+			return "", false
+		}
+		network := net.IPNet{IP: dest, Mask: net.CIDRMask(int(prefix), 128)}
+		return fields[9], network.Contains(ip)
+	})
+}
+
+func usableRoute(flags uint64) bool {
+	return flags&rtfUp != 0 && flags&rtfReject == 0
+}
+
+// readRoutes collects the interfaces of the routes in the table at path
+// that match says cover the address
+func readRoutes(path string, match func(fields []string) (string, bool)) (map[string]bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	ifaces := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if iface, ok := match(strings.Fields(scanner.Text())); ok {
+			ifaces[iface] = true
+		}
+	}
+	return ifaces, scanner.Err()
+}
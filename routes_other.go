@@ -0,0 +1,12 @@
+//go:build !linux
+
+package gonami
+
+import (
+	"errors"
+	"net"
+)
+
+func routedInterfaces(ip net.IP) (map[string]bool, error) {
+	return nil, errors.New("Reading the routing table is not supported on this platform")
+}
@@ -0,0 +1,92 @@
+package gonami
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	pingInterval          = 500 * time.Millisecond
+	minRetransmitInterval = 10 * time.Millisecond
+	maxRetransmitInterval = 5 * time.Second
+	minReadTimeout        = 200 * time.Millisecond
+	maxReadTimeout        = 10 * time.Second
+)
+
+// rttEstimator keeps a smoothed round trip time of the control channel,
+// the same way TCP does (RFC 6298), and derives the client's timers
+// from it. until there is a measurement, the fixed defaults are used
+type rttEstimator struct {
+	mu       sync.Mutex
+	srtt     time.Duration
+	rttvar   time.Duration
+	measured bool
+}
+
+func (r *rttEstimator) sample(rtt time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.measured {
+		r.srtt = rtt
+		r.rttvar = rtt / 2
+		r.measured = true
+		return
+	}
+	delta := r.srtt - rtt
+	if delta < 0 {
+		delta = -delta
+	}
+	r.rttvar = (3*r.rttvar + delta) / 4
+	r.srtt = (7*r.srtt + rtt) / 8
+}
+
+func (r *rttEstimator) rtt() time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.srtt
+}
+
+// retransmitInterval is how often retransmit requests go out. a couple
+// of round trips gives requested blocks a chance to arrive before they
+// are asked for again
+func (r *rttEstimator) retransmitInterval() time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.measured {
+		return retransmitTimeDelta
+	}
+	return clampDuration(2*r.srtt, minRetransmitInterval, maxRetransmitInterval)
+}
+
+// tailHoldback is how long the client waits after the end of a pass
+// before asking for what is missing, so that blocks sent just before
+// it are counted rather than asked for again
+func (r *rttEstimator) tailHoldback() time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.measured {
+		return retransmitTimeDelta
+	}
+	return clampDuration(r.srtt, minRetransmitInterval, maxRetransmitInterval)
+}
+
+// readTimeout is how long the data channel can be silent before the
+// client asks the server to restart
+func (r *rttEstimator) readTimeout() time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.measured {
+		return readTimeout
+	}
+	return clampDuration(r.srtt+4*r.rttvar, minReadTimeout, maxReadTimeout)
+}
+
+func clampDuration(d time.Duration, min time.Duration, max time.Duration) time.Duration {
+	if d < min {
+		return min
+	}
+	if d > max {
+		return max
+	}
+	return d
+}
@@ -1,10 +1,15 @@
 package gonami
 
 import (
-	"fmt"
+	"context"
+	"crypto/tls"
 	"log"
 	"net"
 	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/quic-go/quic-go"
 )
 
 type Server struct {
@@ -12,6 +17,20 @@ type Server struct {
 	encoder          Encoder
 	TransfersChannel chan chan Progress
 	localDirectory   string
+	ReadAheadSize    int         //size in bytes of each sequential read from disk
+	ReadAheadDepth   int         //number of chunks read ahead of the sender
+	ReadCacheSize    int         //number of already sent chunks kept for retransmits
+	UseMmap          bool        //map files into memory instead of reading them
+	RetransmitRatio  int         //retransmitted blocks sent per original block, 0 sends retransmits first
+	ListenAddr       string      //local address to listen for clients on, every interface when empty
+	DataAddr         string      //local address to send the data from, when empty the system picks, or passive clients get the control connection's
+	DataPortMin      int         //first port to send the data from, or listen on for passive clients, any free port when 0
+	DataPortMax      int         //last port to send the data from, or listen on for passive clients, DataPortMin when 0
+	DataSourcePort   int         //send all the data from this one port instead. passive clients still get ports from the range
+	ControlDSCP      int         //DSCP to mark our end of control connections with, 0 leaves them unmarked
+	QUIC             bool        //also take control connections over QUIC, on the same port over UDP, where passive clients get the data from too
+	TLSConfig        *tls.Config //certificate for QUIC, when nil a self signed one, whose fingerprint is logged for clients to pin
+	Network          Network     //opens the connections and sockets, the system's network when nil
 }
 
 type serverTransfer struct {
@@ -20,6 +39,11 @@ type serverTransfer struct {
 	fn         string
 	ld         string
 	controlCh  chan controlMsg
+	sendDone   chan bool //closed once sendFile has returned
+	srv        *Server
+	transport  TransportType
+	local      bool          //the client is copying the file itself
+	rtt        time.Duration //of the control connection, measured during the handshake
 }
 
 type controlMsgType int
@@ -29,11 +53,24 @@ type controlMsg struct {
 	payload interface{}
 }
 
+// control hands msg to sendFile, or returns false if it has already
+// given up on the transfer
+func (st *serverTransfer) control(msg controlMsg) bool {
+	select {
+	case st.controlCh <- msg:
+		return true
+	case <-st.sendDone:
+		return false
+	}
+}
+
 func (st *serverTransfer) config() Config {
 	return st.c
 }
 
 func (st *serverTransfer) updateProgress(progress Progress) {
+	progress.Transport = st.transport
+	progress.Local = st.local
 	select {
 	case st.progressCh <- progress:
 		log.Println("Notifying progress listener")
@@ -54,48 +91,118 @@ func (st *serverTransfer) fullPath() string {
 	return filepath.Join(st.localDirectory(), st.filename())
 }
 
-func newServerTransfer(progressCh chan Progress, localDirectory string) *serverTransfer {
-	return &serverTransfer{progressCh: progressCh, ld: localDirectory}
+func newServerTransfer(progressCh chan Progress, s *Server) *serverTransfer {
+	return &serverTransfer{progressCh: progressCh, ld: s.localDirectory, srv: s}
 }
 
 func NewServer(encoder Encoder, port int, localDirectory string) *Server {
 	tc := make(chan chan Progress)
-	return &Server{port: port, encoder: encoder, TransfersChannel: tc, localDirectory: localDirectory}
+	return &Server{port: port, encoder: encoder, TransfersChannel: tc, localDirectory: localDirectory,
+		ReadAheadSize:  defaultReadAheadSize,
+		ReadAheadDepth: defaultReadAheadDepth,
+		ReadCacheSize:  defaultReadCacheSize}
+}
+
+// dataBinding is where the sockets the data is sent from are bound
+func (s *Server) dataBinding() (dataBinding, error) {
+	local, err := bindAddr(s.DataAddr)
+	if err != nil {
+		return dataBinding{}, err
+	}
+	return dataBinding{network: orSystem(s.Network), local: local, portMin: s.DataPortMin, portMax: s.DataPortMax,
+		sourcePort: s.DataSourcePort}, nil
 }
 
 func (s *Server) StartListening() {
-	l, err := net.Listen("tcp", fmt.Sprintf(":%d", s.port))
+	l, err := orSystem(s.Network).Listen("tcp", net.JoinHostPort(s.ListenAddr, strconv.Itoa(s.port)))
 	if err != nil {
 		log.Fatal("Error listening:", err.Error())
 	}
 	// Close the listener when the application closes.
 	defer l.Close()
+	if s.QUIC {
+		go s.listenQUIC()
+	}
 	for {
 		// Listen for an incoming connection.
 		conn, err := l.Accept()
 		if err != nil {
 			log.Fatal("Error accepting: ", err.Error())
 		}
-		// Handle connections in a new goroutine.
-		log.Println("Incoming connection accepted")
-		ch := make(chan Progress)
-		//non blocking send, in case the server doesn't care about
-		//tracking progress
-		select {
-		case s.TransfersChannel <- ch:
-			log.Println("Initializing progress listener")
-		default:
-			log.Println("No progess listener...")
+		if s.ControlDSCP != 0 {
+			if err := setDSCP(conn, remoteIP(conn), s.ControlDSCP); err != nil {
+				log.Println("Error marking control connection: " + err.Error())
+			}
+		}
+		s.accept(conn)
+	}
+}
+
+// listenQUIC takes control connections over QUIC. passive clients
+// punch the same socket for the data
+func (s *Server) listenQUIC() {
+	tlsConf := s.TLSConfig
+	if tlsConf == nil {
+		var err error
+		if tlsConf, err = selfSignedTLSConfig(); err != nil {
+			log.Fatal("Error creating certificate: ", err.Error())
+		}
+	}
+	tlsConf = tlsConf.Clone()
+	tlsConf.NextProtos = []string{quicALPN}
+	udpConn, err := orSystem(s.Network).ListenPacket("udp", net.JoinHostPort(s.ListenAddr, strconv.Itoa(s.port)))
+	if err != nil {
+		log.Fatal("Error listening:", err.Error())
+	}
+	defer udpConn.Close()
+	if s.ControlDSCP != 0 {
+		//clients can come over IPv4 as well as IPv6
+		if err := setDSCP(udpConn, net.IPv4zero, s.ControlDSCP); err != nil {
+			log.Println("Error marking control connections: " + err.Error())
+		}
+	}
+	tr := &quic.Transport{Conn: udpConn}
+	defer tr.Close()
+	l, err := tr.Listen(tlsConf, quicConfig())
+	if err != nil {
+		log.Fatal("Error listening:", err.Error())
+	}
+	punches := newPunchRouter(udpConn)
+	go punches.run(tr)
+	for {
+		conn, err := l.Accept(context.Background())
+		if err != nil {
+			log.Fatal("Error accepting: ", err.Error())
 		}
-		go s.handleRequest(conn, ch)
+		s.accept(newQUICConn(conn, nil, nil, true, punches, orSystem(s.Network)))
+	}
+}
+
+// accept hands a new control connection off to be handled
+func (s *Server) accept(conn net.Conn) {
+	// Handle connections in a new goroutine.
+	log.Println("Incoming connection accepted")
+	ch := make(chan Progress)
+	//non blocking send, in case the server doesn't care about
+	//tracking progress
+	select {
+	case s.TransfersChannel <- ch:
+		log.Println("Initializing progress listener")
+	default:
+		log.Println("No progess listener...")
 	}
+	go s.handleRequest(conn, ch)
 }
 
 func (s *Server) handleRequest(conn net.Conn, ch chan Progress) {
 	defer conn.Close()
 	defer close(ch)
-	st := newServerTransfer(ch, s.localDirectory)
+	st := newServerTransfer(ch, s)
 	st.updateProgress(Progress{Type: HANDSHAKING, Message: "Accepted connection from: " + conn.RemoteAddr().String(), Percentage: 0})
 	readPackets(conn, s.encoder, st, onVersionState)
+	//stop sending if the client went away without finishing
+	if st.sendDone != nil {
+		st.control(controlMsg{msgType: DONE})
+	}
 	log.Println("Closing connection")
 }
@@ -9,131 +9,199 @@ import (
 	"time"
 )
 
-func sendFile(client string, e Encoder, t *serverTransfer) {
-	listeningAddr, err := net.ResolveUDPAddr("udp", client)
-	if err != nil {
-		log.Println("Error resolving: " + client)
-		return
-	}
+// maxPacingLag is how far the sender can fall behind its schedule
+// before it stops trying to catch up
+const maxPacingLag = 5 * time.Millisecond
+
+// sendFile sends the file over a data stream down each of paths,
+// striping the blocks across them. without any paths, it is sent over
+// the control connection
+func sendFile(paths []dataPath, e Encoder, controlConn net.Conn, t *serverTransfer) {
+	defer close(t.sendDone)
+	defer closePaths(paths)
 	file, err := os.Open(t.fullPath()) // For read access.
 	if err != nil {
-		log.Println("Error opening file: " + err.Error())
+		abortTransfer("Error opening file: "+err.Error(), controlConn, e, t)
+		return
 	}
+	defer file.Close()
 
 	stat, err := file.Stat()
 	if err != nil {
-		log.Println("Error getting file stats: " + err.Error())
+		abortTransfer("Error getting file stats: "+err.Error(), controlConn, e, t)
+		return
 	}
 	filesize := stat.Size()
 	log.Println(filesize)
 	blockSize := t.config().BlockSize
 	transferRate := float64(t.config().TransferRate) * 0.125 //get the transfer in bytes per second
 
-	blockRate := int(math.Floor(transferRate / float64(blockSize))) //how many blocks we can send in one second
 	numBlocks := int(math.Ceil(float64(filesize) / float64(blockSize)))
 
-	conn, err := net.DialUDP("udp", nil, listeningAddr)
+	br := newBlockReader(file, filesize, blockSize, t.srv)
+	defer br.close()
 
-	sendPacketCh := make(chan *Packet)
-	blockRateCh := make(chan float64)
-	doneCh := make(chan bool)
-	canStopRetransmit := make(chan chan bool)
+	batchSize := t.config().BatchSize
 
-	defer close(sendPacketCh)
-	defer close(blockRateCh)
-	defer close(doneCh)
-	defer close(canStopRetransmit)
+	//a stream down each path, or the control connection when UDP
+	//didn't get through
+	var writers []packetWriter
+	for _, path := range paths {
+		if t.config().DataDSCP != 0 && !path.shared {
+			if err := setDSCP(path.conn, path.remote().IP, t.config().DataDSCP); err != nil {
+				log.Println("Error marking data stream: " + err.Error())
+			}
+		}
+		writers = append(writers, newBatchWriter(path.conn, path.addr, batchSize))
+	}
+	if len(writers) == 0 {
+		writers = append(writers, newFrameWriter(controlConn, batchSize))
+	}
 
-	go func() {
-		packetSender(blockRate, conn, e, sendPacketCh, blockRateCh, doneCh)
-	}()
+	//buffered so the senders can top up a batch without waiting on the scheduler
+	sendPacketCh := make(chan Block, batchSize*len(writers))
+	//block buffers are recycled once the sender has encoded them
+	blockPool := newBufferPool(blockSize, 2*batchSize*len(writers)+t.config().FECMaxParityShards+2)
+	//each sender's rate is kept here, and the senders are handed the
+	//latest one
+	rates := make([]float64, len(writers))
+	rateChs := make([]chan float64, len(writers))
+	doneCh := make(chan bool)
+	passDoneCh := make(chan bool, 1)
 
-	//send the inital set of packets
-	go func() {
-		for i := 0; i < numBlocks; i++ {
-			sendDataPkt(file, blockSize, i, sendPacketCh, ORIGINAL)
-		}
+	var senders sync.WaitGroup
+	defer func() {
+		close(doneCh)
+		senders.Wait()
+		close(sendPacketCh)
 	}()
-	//listen for commands messages
-	canStop := false
-	increaseCount := 0
-	var wg sync.WaitGroup
+
+	//each stream has its own sender, with an even share of the rate,
+	//all taking blocks from the same queue
+	for i, w := range writers {
+		rates[i] = transferRate / float64(len(writers))
+		rateChs[i] = make(chan float64, 1)
+		senders.Add(1)
+		go func(w packetWriter, rate float64, rateCh chan float64) {
+			defer senders.Done()
+			packetSender(rate, w, len(writers) > 1, e, blockPool, numBlocks-1, sendPacketCh, rateCh, doneCh, passDoneCh)
+		}(w, rates[i], rateChs[i])
+	}
+
+	//a single scheduler feeds the sender with both the original pass
+	//and the retransmits, while listening for command messages
+	scheduler := newSendScheduler(numBlocks, t.srv.RetransmitRatio)
+	//each stream's rate is adjusted for the loss on its own path when
+	//there are several, so load shifts away from a degraded path
+	increaseCounts := make([]int, len(writers))
+	//parity for each group goes out right behind its data blocks. TCP
+	//doesn't lose any
+	var fec *fecEncoder
+	if t.config().FECDataShards > 0 && len(paths) > 0 {
+		fec = newFECEncoder(t.config(), numBlocks)
+	}
+	var parity []Block
+	compressor := newBlockCompressor(t.config().Compression, blockPool)
+	if compressor != nil {
+		defer compressor.close()
+	}
+	var pending *Block
 	for {
+		var out chan Block
+		var block Block
+		if pending == nil {
+			if len(parity) > 0 {
+				block = parity[0]
+				parity = parity[1:]
+				pending = &block
+			} else if index, blockType, ok := scheduler.nextBlock(); ok {
+				var err error
+				block, err = readDataBlock(br, blockPool, index, blockType)
+				if err != nil {
+					log.Println("Error reading block: " + err.Error())
+					continue
+				}
+				pending = &block
+				if fec != nil && blockType == ORIGINAL {
+					parity = fec.add(block, blockPool)
+				}
+				if compressor != nil {
+					compressor.compress(pending)
+				}
+			}
+		}
+		if pending != nil {
+			out = sendPacketCh
+			block = *pending
+		}
 		select {
 		case msg := <-t.controlCh:
-			if msg.msgType == DONE {
-				doneCh <- true
-				canStop = true
-				wg.Wait()
+			if msg.msgType == DONE || msg.msgType == TRANSFER_ERROR {
 				return
 			}
 			if msg.msgType == RETRANSMIT {
-				rt := msg.payload.(Retransmit)
-				blocks := rt.BlockNums
-				wg.Add(1)
-				go func() {
-					defer wg.Done()
-					canStopResponseCh := make(chan bool)
-					if !rt.IsRestart {
-						for _, block := range blocks {
-							//this is a bit of a hack, but the transfer can potentially
-							//be done, but since this is in the a goroutine it won't know
-							//with out asking (or being told..)
-							if canStopSendingPackets(canStopResponseCh, canStopRetransmit) {
-								return
-							}
-							sendDataPkt(file, blockSize, block, sendPacketCh, RETRANSMITTED)
-						}
-
-					} else {
-						startBlock := blocks[0]
-						for i := startBlock; i < numBlocks; i++ {
-							if canStopSendingPackets(canStopResponseCh, canStopRetransmit) {
-								return
-							}
-							sendDataPkt(file, blockSize, i, sendPacketCh, ORIGINAL)
-						}
-					}
-				}()
+				scheduler.retransmit(msg.payload.(Retransmit))
 			}
 			if msg.msgType == ERROR_RATE {
 				errorRate := msg.payload.(float64)
-				updateSendRate(errorRate, &increaseCount, t.config(), blockRateCh)
+				if len(rateChs) == 1 {
+					updateSendRate(errorRate, &increaseCounts[0], t.config(), &rates[0], rateChs[0])
+				}
+				if fec != nil {
+					fec.adapt(errorRate)
+				}
+			}
+			if msg.msgType == ERROR_RATES {
+				errorRates := msg.payload.(PathErrorRates).Rates
+				for i := 0; i < len(errorRates) && i < len(rateChs); i++ {
+					updateSendRate(errorRates[i], &increaseCounts[i], t.config(), &rates[i], rateChs[i])
+				}
+			}
+		case out <- block:
+			pending = nil
+		case <-passDoneCh:
+			//let the client know it has seen everything it is going to,
+			//so it can ask for what is missing straight away
+			outPkt := &Packet{Type: END_OF_PASS, Payload: numBlocks - 1}
+			_, err := sendPacket(outPkt, controlConn, e)
+			if err != nil {
+				log.Println("Error sending END_OF_PASS: " + err.Error())
 			}
-		case ch := <-canStopRetransmit:
-			ch <- canStop
 		}
 	}
 
 }
 
-func sendDataPkt(file *os.File, blockSize int, blockIndex int, packetCh chan *Packet, blockType BlockType) {
-	bytes := make([]byte, blockSize)
-	numBytes, _ := file.ReadAt(bytes, int64(blockIndex*blockSize))
+func readDataBlock(br *blockReader, pool *bufferPool, blockIndex int, blockType BlockType) (Block, error) {
+	bytes := pool.get()
+	numBytes, err := br.readBlock(bytes, blockIndex)
+	if err != nil {
+		pool.put(bytes)
+		return Block{}, err
+	}
 	//if we are at the end of the file, chances are the bytes left will
 	//be less than blockSize, so adjust
-	if numBytes < blockSize {
-		bytes = bytes[0:numBytes]
-	}
-	block := Block{Number: blockIndex, Data: bytes, Type: blockType}
-	outPkt := &Packet{Type: DATA, Payload: block}
-	packetCh <- outPkt
+	return Block{Number: blockIndex, Data: bytes[0:numBytes], Type: blockType}, nil
 }
 
-func updateSendRate(errorRate float64, increaseCount *int, config Config, blockRateCh chan float64) {
+// updateSendRate adjusts a sender's byte rate for the error rate
+// reported on its path, and hands it the new rate
+func updateSendRate(errorRate float64, increaseCount *int, config Config, rate *float64, rateCh chan float64) {
 	targetErrorRate := float64(config.ErrorRate) / float64(10000)
 	increaseRate := 0.25
 	consecutiveIncrease := 15
 	if errorRate > targetErrorRate {
 		percent := float64(config.SlowerNum) / float64(config.SlowerDen)
-		blockRateCh <- percent
+		*rate = *rate / percent
+		setRate(rateCh, *rate)
 		log.Println("Decreasing rate")
 	}
 	if errorRate < increaseRate {
 		*increaseCount++
 		if *increaseCount > consecutiveIncrease {
 			percent := float64(config.FasterNum) / float64(config.FasterDen)
-			blockRateCh <- percent
+			*rate = *rate / percent
+			setRate(rateCh, *rate)
 			*increaseCount = 0
 			log.Println("Increasing rate")
 		}
@@ -141,34 +209,96 @@ func updateSendRate(errorRate float64, increaseCount *int, config Config, blockR
 
 }
 
-func canStopSendingPackets(canStopResponseCh chan bool, canStopRetransmit chan chan bool) bool {
-	canStopRetransmit <- canStopResponseCh
-	canStopSending := <-canStopResponseCh
-	return canStopSending
+// setRate hands a sender its new rate without waiting on it, replacing
+// one it hasn't picked up yet. the scheduler is the only one setting it
+func setRate(rateCh chan float64, rate float64) {
+	select {
+	case <-rateCh:
+	default:
+	}
+	rateCh <- rate
 }
 
-func packetSender(initialBlockRate int, conn net.Conn, e Encoder, packetCh chan *Packet, blockRateCh chan float64, doneCh chan bool) {
-	blockRate := initialBlockRate
-	rate := time.Second / time.Duration(blockRate)
-	throttle := time.NewTicker(rate)
+// packetSender paces blocks out onto a data stream, by the bytes
+// of block data rather than the number of blocks, so compressed blocks
+// go out faster. numbered senders give each packet a sequence number.
+// once the last block of a pass over the file has gone out, it signals
+// passDoneCh
+func packetSender(initialByteRate float64, w packetWriter, numbered bool, e Encoder, pool *bufferPool, lastBlock int, packetCh chan Block, rateCh chan float64, doneCh chan bool, passDoneCh chan bool) {
+	byteRate := initialByteRate
+	if byteRate < 1 {
+		byteRate = 1
+	}
+	//when each batch is due to go out
+	next := time.Now()
+	seq := 0
+	queue := func(block *Block) int {
+		if numbered {
+			seq++
+			block.Seq = seq
+		}
+		return queueBlock(w, block, e, pool)
+	}
 	for {
 		select {
-		case packet := <-packetCh:
-			if packet != nil {
-				<-throttle.C
-				_, err := sendPacket(packet, conn, e)
-				if err != nil {
-					log.Println("Error sending packet: " + err.Error())
+		case block, ok := <-packetCh:
+			if ok {
+				if wait := time.Until(next); wait > 0 {
+					time.Sleep(wait)
+				}
+				endsPass := block.Type == ORIGINAL && block.Number == lastBlock
+				bytes := queue(&block)
+				//top up the batch with whatever has been queued while we waited
+			fill:
+				for !w.full() {
+					select {
+					case b, ok := <-packetCh:
+						if !ok {
+							break fill
+						}
+						endsPass = endsPass || b.Type == ORIGINAL && b.Number == lastBlock
+						bytes += queue(&b)
+					default:
+						break fill
+					}
+				}
+				if err := w.flush(); err != nil {
+					log.Println("Error sending packets: " + err.Error())
+				}
+				//oversleeping a little is made up on the next batches, but
+				//time spent idle isn't saved up into a burst
+				now := time.Now()
+				if now.Sub(next) > maxPacingLag {
+					next = now
+				}
+				next = next.Add(time.Duration(float64(bytes) / byteRate * float64(time.Second)))
+				if endsPass {
+					select {
+					case passDoneCh <- true:
+					default:
+					}
 				}
-
 			}
-		case newRatePercent := <-blockRateCh:
-			blockRate = int(math.Ceil(float64(blockRate) / newRatePercent))
-			throttle.Stop()
-			throttle = time.NewTicker(time.Second / time.Duration(blockRate))
+		case byteRate = <-rateCh:
+			if byteRate < 1 {
+				byteRate = 1
+			}
 		case <-doneCh:
-			throttle.Stop()
 			return
 		}
 	}
 }
+
+// queueBlock encodes block into the writer's next buffer, and
+// recycles the block's data. it returns the size of the data
+func queueBlock(w packetWriter, block *Block, e Encoder, pool *bufferPool) int {
+	size := len(block.Data)
+	b, err := appendBlock(e, w.buf(), block)
+	pool.put(block.Data)
+	if err != nil {
+		log.Println("Error encoding packet: " + err.Error())
+		return 0
+	}
+	w.add(b)
+	return size
+}
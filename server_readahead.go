@@ -0,0 +1,190 @@
+package gonami
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+)
+
+const (
+	defaultReadAheadSize  = 1 << 20 //bytes read from disk at a time
+	defaultReadAheadDepth = 4       //chunks read ahead of the sender
+	defaultReadCacheSize  = 4       //chunks kept behind the sender for retransmits
+)
+
+type chunk struct {
+	data  []byte
+	ready chan bool //closed once data has been read
+	used  uint64
+}
+
+// blockReader serves blocks out of large sequential reads of the file.
+// a background goroutine keeps the chunks ahead of the last block read
+// loaded, and recently read chunks are kept around so that most
+// retransmits never touch the disk
+type blockReader struct {
+	r         io.ReaderAt
+	filesize  int64
+	mapped    []byte
+	blockSize int
+	chunkSize int
+	depth     int
+	maxChunks int
+
+	mu     sync.Mutex
+	chunks map[int]*chunk
+	clock  uint64
+
+	prefetchCh chan int
+	done       chan bool
+	//furthest chunk read so far, the prefetcher only follows the reads
+	//that go past it
+	furthest int
+
+	//readers of mapped hold it, so it isn't unmapped under them
+	mapLock sync.RWMutex
+	closed  bool
+}
+
+func newBlockReader(file *os.File, filesize int64, blockSize int, s *Server) *blockReader {
+	br := &blockReader{r: file, filesize: filesize, blockSize: blockSize}
+	if s.UseMmap {
+		mapped, err := mmapFile(file, filesize)
+		if err == nil {
+			br.mapped = mapped
+			return br
+		}
+		log.Println("Error mapping file, falling back to reads: " + err.Error())
+	}
+	//chunks are always a whole number of blocks
+	br.chunkSize = (s.ReadAheadSize / blockSize) * blockSize
+	if br.chunkSize < blockSize {
+		br.chunkSize = blockSize
+	}
+	br.depth = s.ReadAheadDepth
+	br.maxChunks = s.ReadAheadDepth + s.ReadCacheSize + 1
+	br.chunks = make(map[int]*chunk)
+	br.prefetchCh = make(chan int, 1)
+	br.furthest = -1
+	br.done = make(chan bool)
+	go br.prefetch()
+	return br
+}
+
+// readBlock copies block number index into buf, returning the number
+// of bytes in the block
+func (br *blockReader) readBlock(buf []byte, index int) (int, error) {
+	offset := int64(index) * int64(br.blockSize)
+	if index < 0 || offset >= br.filesize {
+		return 0, errors.New("Block " + strconv.Itoa(index) + " is outside the file")
+	}
+	if br.mapped != nil {
+		br.mapLock.RLock()
+		defer br.mapLock.RUnlock()
+		if br.closed {
+			return 0, os.ErrClosed
+		}
+		return copy(buf[:br.blockSize], br.mapped[offset:]), nil
+	}
+	c := int(offset / int64(br.chunkSize))
+	ch := br.load(c)
+	//let the prefetcher know when the pass moves on to a new chunk,
+	//without waiting on it. going back for a retransmit would have it
+	//read behind the pass, pushing out the chunks it still needs
+	br.mu.Lock()
+	forward := c > br.furthest
+	if forward {
+		br.furthest = c
+	}
+	br.mu.Unlock()
+	if forward {
+		//replacing a position it hasn't picked up yet
+		select {
+		case <-br.prefetchCh:
+		default:
+		}
+		select {
+		case br.prefetchCh <- c:
+		default:
+		}
+	}
+	start := int(offset - int64(c)*int64(br.chunkSize))
+	if start >= len(ch.data) {
+		return 0, io.ErrUnexpectedEOF
+	}
+	end := start + br.blockSize
+	if end > len(ch.data) {
+		end = len(ch.data)
+	}
+	return copy(buf, ch.data[start:end]), nil
+}
+
+// load returns chunk c, reading it from disk if it isn't cached
+func (br *blockReader) load(c int) *chunk {
+	br.mu.Lock()
+	br.clock++
+	if ch, ok := br.chunks[c]; ok {
+		ch.used = br.clock
+		br.mu.Unlock()
+		<-ch.ready
+		return ch
+	}
+	ch := &chunk{ready: make(chan bool), used: br.clock}
+	br.chunks[c] = ch
+	br.evict()
+	br.mu.Unlock()
+
+	data := make([]byte, br.chunkSize)
+	n, err := br.r.ReadAt(data, int64(c)*int64(br.chunkSize))
+	if err != nil && err != io.EOF {
+		log.Println("Error reading file: " + err.Error())
+	}
+	ch.data = data[:n]
+	close(ch.ready)
+	return ch
+}
+
+// evict drops the least recently used chunks once the cache is full.
+// must be called with mu held
+func (br *blockReader) evict() {
+	for len(br.chunks) > br.maxChunks {
+		oldest := -1
+		for c, ch := range br.chunks {
+			if oldest == -1 || ch.used < br.chunks[oldest].used {
+				oldest = c
+			}
+		}
+		delete(br.chunks, oldest)
+	}
+}
+
+func (br *blockReader) prefetch() {
+	for {
+		select {
+		case c := <-br.prefetchCh:
+			for i := c + 1; i <= c+br.depth; i++ {
+				if int64(i)*int64(br.chunkSize) >= br.filesize {
+					break
+				}
+				br.load(i)
+			}
+		case <-br.done:
+			return
+		}
+	}
+}
+
+func (br *blockReader) close() {
+	if br.mapped != nil {
+		//the original pass and the retransmits may still be reading
+		br.mapLock.Lock()
+		br.closed = true
+		br.mapLock.Unlock()
+		munmapFile(br.mapped)
+		return
+	}
+	close(br.done)
+}
@@ -0,0 +1,80 @@
+package gonami
+
+import (
+	"bytes"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// openReadaheadFile writes size random bytes to a file to read blocks
+// of back
+func openReadaheadFile(t *testing.T, size int) (*os.File, []byte) {
+	data := make([]byte, size)
+	rand.Read(data)
+	path := filepath.Join(t.TempDir(), "f")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f, data
+}
+
+func TestBlockReader(t *testing.T) {
+	const blockSize = 100
+	//a short last block, and several chunks
+	const size = 10*blockSize + 37
+	for _, useMmap := range []bool{false, true} {
+		f, data := openReadaheadFile(t, size)
+		s := NewServer(BsonEncoder{}, 0, "")
+		s.UseMmap = useMmap
+		s.ReadAheadSize = 3 * blockSize
+		br := newBlockReader(f, size, blockSize, s)
+		buf := make([]byte, blockSize)
+		//in order, then back for retransmits
+		for _, index := range []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 2, 0, 7} {
+			n, err := br.readBlock(buf, index)
+			if err != nil {
+				t.Fatalf("mmap %v, block %d: %v", useMmap, index, err)
+			}
+			end := min((index+1)*blockSize, size)
+			if !bytes.Equal(buf[:n], data[index*blockSize:end]) {
+				t.Errorf("mmap %v, block %d: wrong data", useMmap, index)
+			}
+		}
+		for _, index := range []int{-1, -3, 11, 1 << 30} {
+			if _, err := br.readBlock(buf, index); err == nil {
+				t.Errorf("mmap %v: block %d outside the file was read", useMmap, index)
+			}
+		}
+		br.close()
+	}
+}
+
+// TestBlockReaderRetransmitsDontPrefetch checks going back for an early
+// block leaves the prefetcher where the original pass is
+func TestBlockReaderRetransmitsDontPrefetch(t *testing.T) {
+	const blockSize = 100
+	f, _ := openReadaheadFile(t, 20*blockSize)
+	//without a prefetcher running, to see what it would be told
+	br := &blockReader{r: f, filesize: 20 * blockSize, blockSize: blockSize, chunkSize: blockSize, depth: 1,
+		maxChunks: 4, chunks: make(map[int]*chunk), prefetchCh: make(chan int, 1), furthest: -1}
+	buf := make([]byte, blockSize)
+	br.readBlock(buf, 10)
+	<-br.prefetchCh
+	br.readBlock(buf, 2)
+	select {
+	case c := <-br.prefetchCh:
+		t.Errorf("prefetcher moved back to chunk %d", c)
+	default:
+	}
+	br.readBlock(buf, 11)
+	if c := <-br.prefetchCh; c != 11 {
+		t.Errorf("prefetcher at chunk %d, want 11", c)
+	}
+}
@@ -0,0 +1,82 @@
+package gonami
+
+import (
+	"log"
+	"strconv"
+)
+
+// sendScheduler picks the next block to send for a transfer. it merges
+// the original pass over the file with the blocks the client asked to
+// have retransmitted, which are kept in a deduplicated queue ordered by
+// block number
+type sendScheduler struct {
+	numBlocks     int
+	next          int //next block of the original pass
+	retransmits   rangeList
+	ratio         int //retransmitted blocks sent per original block
+	sinceOriginal int
+}
+
+func newSendScheduler(numBlocks int, ratio int) *sendScheduler {
+	return &sendScheduler{numBlocks: numBlocks, ratio: ratio}
+}
+
+// retransmit queues up the blocks of rt. blocks that are already
+// waiting to go out again are not queued twice, and blocks outside the
+// file are dropped
+func (s *sendScheduler) retransmit(rt Retransmit) {
+	if rt.IsRestart {
+		if rt.Base < 0 || rt.Base >= s.numBlocks {
+			log.Println("Ignoring restart from outside the file: " + strconv.Itoa(rt.Base))
+			return
+		}
+		//the original pass picks up from the restart block, so anything
+		//queued past it would be sent twice
+		if rt.Base < s.next {
+			s.next = rt.Base
+		}
+		s.retransmits = s.retransmits.truncate(s.next)
+		return
+	}
+	ranges, err := decodeRanges(rt.Base, rt.Ranges)
+	if err != nil {
+		log.Println("Error decoding retransmit request: " + err.Error())
+		return
+	}
+	for _, r := range ranges {
+		//decodeRanges never gives a negative start
+		if r.end > s.numBlocks {
+			r.end = s.numBlocks
+		}
+		//blocks the original pass hasn't reached yet will go out anyway
+		if r.end > s.next {
+			r.end = s.next
+		}
+		s.retransmits = s.retransmits.insert(r.start, r.end)
+	}
+}
+
+// nextBlock returns the block to send next, if there is one. with a
+// ratio of 0 retransmits always go first, otherwise ratio retransmitted
+// blocks are sent for every original block while both are waiting
+func (s *sendScheduler) nextBlock() (int, BlockType, bool) {
+	hasOriginal := s.next < s.numBlocks
+	hasRetransmit := len(s.retransmits) > 0
+	if hasRetransmit && (!hasOriginal || s.ratio == 0 || s.sinceOriginal < s.ratio) {
+		r := &s.retransmits[0]
+		block := r.start
+		r.start++
+		if r.start == r.end {
+			s.retransmits = s.retransmits[1:]
+		}
+		s.sinceOriginal++
+		return block, RETRANSMITTED, true
+	}
+	if hasOriginal {
+		block := s.next
+		s.next++
+		s.sinceOriginal = 0
+		return block, ORIGINAL, true
+	}
+	return 0, ORIGINAL, false
+}
@@ -0,0 +1,127 @@
+package gonami
+
+import (
+	"reflect"
+	"testing"
+)
+
+// far past the end of any file, on 32 bit platforms too
+const bigRange = 1 << 30
+
+type scheduled struct {
+	block     int
+	blockType BlockType
+}
+
+// drainScheduler takes up to n blocks off s, in the order it sends them
+func drainScheduler(s *sendScheduler, n int) []scheduled {
+	var out []scheduled
+	for len(out) < n {
+		block, blockType, ok := s.nextBlock()
+		if !ok {
+			break
+		}
+		out = append(out, scheduled{block, blockType})
+	}
+	return out
+}
+
+func retransmitOf(l rangeList) Retransmit {
+	base, ranges := encodeRanges(l)
+	return Retransmit{Base: base, Ranges: ranges}
+}
+
+func originals(from int, to int) []scheduled {
+	var out []scheduled
+	for b := from; b < to; b++ {
+		out = append(out, scheduled{b, ORIGINAL})
+	}
+	return out
+}
+
+func TestSchedulerRatio(t *testing.T) {
+	const o, r = ORIGINAL, RETRANSMITTED
+	for _, test := range []struct {
+		ratio int
+		want  []scheduled
+	}{
+		//retransmits always go first
+		{0, []scheduled{{2, r}, {3, r}, {4, r}, {5, r}, {10, o}, {11, o}}},
+		{1, []scheduled{{2, r}, {10, o}, {3, r}, {11, o}, {4, r}, {12, o}, {5, r}, {13, o}, {14, o}}},
+		{2, []scheduled{{2, r}, {3, r}, {10, o}, {4, r}, {5, r}, {11, o}, {12, o}}},
+	} {
+		s := newSendScheduler(20, test.ratio)
+		drainScheduler(s, 10)
+		s.retransmit(retransmitOf(rangeList{{2, 6}}))
+		if got := drainScheduler(s, len(test.want)); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ratio %d: got %v, want %v", test.ratio, got, test.want)
+		}
+	}
+}
+
+func TestSchedulerRestart(t *testing.T) {
+	s := newSendScheduler(12, 0)
+	drainScheduler(s, 10)
+	s.retransmit(retransmitOf(rangeList{{2, 4}, {6, 8}}))
+	//the original pass goes back to block 5, so 6 and 7 aren't queued
+	//as well
+	s.retransmit(Retransmit{IsRestart: true, Base: 5})
+	want := append([]scheduled{{2, RETRANSMITTED}, {3, RETRANSMITTED}}, originals(5, 12)...)
+	if got := drainScheduler(s, 100); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	//a restart past where the pass is doesn't skip anything
+	s = newSendScheduler(12, 0)
+	drainScheduler(s, 4)
+	s.retransmit(Retransmit{IsRestart: true, Base: 8})
+	if got := drainScheduler(s, 100); !reflect.DeepEqual(got, originals(4, 12)) {
+		t.Errorf("got %v, want %v", got, originals(4, 12))
+	}
+}
+
+func TestSchedulerDeduplicates(t *testing.T) {
+	s := newSendScheduler(20, 0)
+	drainScheduler(s, 10)
+	s.retransmit(retransmitOf(rangeList{{2, 5}}))
+	s.retransmit(retransmitOf(rangeList{{2, 5}}))
+	s.retransmit(retransmitOf(rangeList{{3, 7}, {8, 9}}))
+	var want []scheduled
+	for _, b := range []int{2, 3, 4, 5, 6, 8} {
+		want = append(want, scheduled{b, RETRANSMITTED})
+	}
+	if got := drainScheduler(s, len(want)); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	//blocks the pass hasn't reached yet aren't queued
+	s.retransmit(retransmitOf(rangeList{{9, 15}}))
+	want = append([]scheduled{{9, RETRANSMITTED}}, originals(10, 20)...)
+	if got := drainScheduler(s, 100); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+// TestSchedulerOutsideFile checks requests for blocks the file doesn't
+// have never get as far as the block reader
+func TestSchedulerOutsideFile(t *testing.T) {
+	s := newSendScheduler(10, 0)
+	drainScheduler(s, 10)
+	for _, rt := range []Retransmit{
+		{IsRestart: true, Base: -3},
+		{IsRestart: true, Base: 10},
+		{Base: -3, Ranges: []byte{0, 2}},
+		retransmitOf(rangeList{{10, 12}}),
+		retransmitOf(rangeList{{bigRange, bigRange + 1}}),
+	} {
+		s.retransmit(rt)
+	}
+	if got := drainScheduler(s, 100); len(got) != 0 {
+		t.Errorf("got %v, want nothing", got)
+	}
+	//the part of a range that is in the file still goes out
+	s.retransmit(retransmitOf(rangeList{{8, 12}}))
+	want := []scheduled{{8, RETRANSMITTED}, {9, RETRANSMITTED}}
+	if got := drainScheduler(s, 100); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
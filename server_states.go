@@ -3,11 +3,12 @@ package gonami
 import (
 	"crypto/md5"
 	"crypto/rand"
-	"fmt"
 	"log"
 	"net"
 	"os"
 	"path/filepath"
+	"strconv"
+	"time"
 )
 
 func onVersionState(pkt *Packet, e Encoder, conn net.Conn, t transfer) stateFn {
@@ -36,24 +37,27 @@ func onBeginAuthState(pkt *Packet, e Encoder, conn net.Conn, t transfer) stateFn
 	//on connection, generate random bytes and send to the client
 	random := generateRandomBytes()
 	outPkt := &Packet{Type: AUTH, Payload: random}
+	sent := time.Now()
 	_, err := sendPacket(outPkt, conn, e)
 	if err != nil {
 		log.Println("Error sending AUTH token: " + err.Error())
 		return nil
 	}
-	//use a closure to capture the value of the randomly generated bytes
+	//use a closure to capture the value of the randomly generated bytes,
+	//and when they went out, the reply gives the round trip time
 	authenticateStateWrapper := func(pkt1 *Packet, e1 Encoder, conn1 net.Conn, t1 transfer) stateFn {
-		return authenticateClientState(pkt1, e1, conn1, t1, random)
+		return authenticateClientState(pkt1, e1, conn1, t1, random, sent)
 	}
 	return authenticateStateWrapper
 }
 
-func authenticateClientState(pkt *Packet, e Encoder, conn net.Conn, t transfer, randomBytes []byte) stateFn {
+func authenticateClientState(pkt *Packet, e Encoder, conn net.Conn, t transfer, randomBytes []byte, sent time.Time) stateFn {
 	log.Println("Authenticating client")
 	if pkt.Type != AUTH {
 		log.Println("Expecting AUTH, did not receive it")
 		return nil
 	}
+	t.(*serverTransfer).rtt = time.Since(sent)
 	//get the bytes the client sent over
 	b, ok := pkt.Payload.([]byte)
 	if !ok {
@@ -143,25 +147,255 @@ func receiveConfigState(pkt *Packet, e Encoder, conn net.Conn, t transfer) state
 		log.Println("Error sending GET_FILE: " + err.Error())
 		return nil
 	}
+	//blocks are flagged when they are compressed, so the client copes
+	//with whatever we decide on
+	if !compressionSupported(config.Compression) {
+		log.Println("Unsupported compression " + config.Compression + ", sending blocks uncompressed")
+		config.Compression = NO_COMPRESSION
+	}
 	//save the config
 	t.(*serverTransfer).c = config
 	t.updateProgress(Progress{Type: HANDSHAKING, Message: "Configuration received. Handshaking complete", Percentage: 1})
-
+	if config.OfferIdentity {
+		return offerFileIdentityState(pkt, e, conn, t)
+	}
 	return acceptListeningPortState
 }
 
+// offerFileIdentityState tells the client which file it is, so that it
+// can copy it itself if it sees the same one
+func offerFileIdentityState(pkt *Packet, e Encoder, conn net.Conn, t transfer) stateFn {
+	id, err := fileIdentity(t.fullPath())
+	if err != nil {
+		//an empty identity has the client carry on as usual
+		log.Println("Error identifying file: " + err.Error())
+		id = FileIdentity{}
+	}
+	outPkt := &Packet{Type: FILE_IDENTITY, Payload: id}
+	if _, err := sendPacket(outPkt, conn, e); err != nil {
+		log.Println("Error sending FILE_IDENTITY: " + err.Error())
+		return nil
+	}
+	return acceptFastPathState
+}
+
+func acceptFastPathState(pkt *Packet, e Encoder, conn net.Conn, t transfer) stateFn {
+	if pkt.Type != FILE_IDENTITY {
+		log.Println("Expecting FILE_IDENTITY, did not receive it")
+		return nil
+	}
+	local, ok := pkt.Payload.(bool)
+	if !ok {
+		log.Println("Incorrect payload type")
+		return nil
+	}
+	if !local {
+		return acceptListeningPortState
+	}
+	t.(*serverTransfer).local = true
+	t.updateProgress(Progress{Type: TRANSFERRING, Message: "Client is copying the file locally", Percentage: 0})
+	return localCopyState
+}
+
+// localCopyState waits for the client to finish copying the file
+func localCopyState(pkt *Packet, e Encoder, conn net.Conn, t transfer) stateFn {
+	if pkt.Type != DONE {
+		log.Println("Expecting DONE, did not receive it")
+		return nil
+	}
+	sendPacket(pkt, conn, e)
+	t.updateProgress(Progress{Type: TRANSFERRING, Message: "Transfer Complete", Percentage: 1})
+	return nil
+}
+
 func acceptListeningPortState(pkt *Packet, e Encoder, conn net.Conn, t transfer) stateFn {
-	port := pkt.Payload.(int)
-	ip := conn.RemoteAddr().(*net.TCPAddr).IP.String()
-	client := fmt.Sprintf("%s:%d", ip, port)
+	if pkt.Type != DATA_PORTS {
+		log.Println("Expecting DATA_PORTS, did not receive it")
+		return nil
+	}
+	ports, ok := pkt.Payload.(DataPorts)
+	if !ok {
+		log.Println("Incorrect payload type")
+		return nil
+	}
+	ip := udpAddr(conn.RemoteAddr()).IP.String()
+	//a host for each stream, for clients receiving over several paths.
+	//the streams are grouped into paths by the hosts the client gave
+	groups := make([]string, len(ports.Ports))
+	var clients []string
+	for i, port := range ports.Ports {
+		host := ip
+		if i < len(ports.Hosts) {
+			groups[i] = ports.Hosts[i]
+			if validPathHost(ports.Hosts[i]) {
+				host = ports.Hosts[i]
+			}
+		}
+		clients = append(clients, net.JoinHostPort(host, strconv.Itoa(port)))
+	}
 	t.(*serverTransfer).controlCh = make(chan controlMsg)
-	go sendFile(client, e, t.(*serverTransfer))
+	binding, err := t.(*serverTransfer).srv.dataBinding()
+	if err != nil {
+		log.Println("Error resolving data address: " + err.Error())
+		t.updateProgress(Progress{Type: ERROR, Message: "Error resolving data address: " + err.Error(), Percentage: 0})
+		return nil
+	}
+	//a client that only wants the data over TCP sends no ports at all
+	var paths []dataPath
+	if t.config().Passive && len(ports.Ports) > 0 {
+		//the client can't be reached until it has sent us something
+		paths, err = acceptPunches(conn, e, len(ports.Ports), binding, t.config().Transport == AUTO_TRANSPORT)
+	} else {
+		paths, err = dialPaths(clients, binding)
+	}
+	if err != nil {
+		log.Println("Error opening data paths: " + err.Error())
+		t.updateProgress(Progress{Type: ERROR, Message: "Error opening data paths: " + err.Error(), Percentage: 0})
+		return nil
+	}
+	if !t.config().Passive && namesHosts(ports.Hosts) {
+		return challengePaths(paths, groups, e, conn, t)
+	}
+	return startPaths(paths, groups, e, conn, t)
+}
+
+// challengePaths sends a nonce down each data stream that goes to a
+// host other than the one the client connected from. no data goes down
+// them until the client has echoed the nonces back, so a client can't
+// have the data sent to a host that didn't ask for it
+func challengePaths(paths []dataPath, groups []string, e Encoder, conn net.Conn, t transfer) stateFn {
+	challenge := PathChallenge{Streams: challengedStreams(paths, udpAddr(conn.RemoteAddr()).IP)}
+	for range challenge.Streams {
+		challenge.Nonces = append(challenge.Nonces, generateRandomBytes()[:challengeNonceSize])
+	}
+	//the client only gets told which streams, the nonces come down them
+	outPkt := &Packet{Type: PATH_CHALLENGE, Payload: PathChallenge{Streams: challenge.Streams}}
+	if _, err := sendPacket(outPkt, conn, e); err != nil {
+		log.Println("Error sending PATH_CHALLENGE: " + err.Error())
+		closePaths(paths)
+		return nil
+	}
+	if len(challenge.Streams) == 0 {
+		return startPaths(paths, groups, e, conn, t)
+	}
+	stop := make(chan bool)
+	go sendChallenges(paths, challenge, stop)
+	acceptPathChallengeStateWrapper := func(pkt1 *Packet, e1 Encoder, conn1 net.Conn, t1 transfer) stateFn {
+		return acceptPathChallengeState(pkt1, e1, conn1, t1, paths, groups, challenge, stop)
+	}
+	return acceptPathChallengeStateWrapper
+}
+
+func acceptPathChallengeState(pkt *Packet, e Encoder, conn net.Conn, t transfer, paths []dataPath, groups []string, challenge PathChallenge, stop chan bool) stateFn {
+	close(stop)
+	if pkt.Type != PATH_CHALLENGE {
+		log.Println("Expecting PATH_CHALLENGE, did not receive it")
+		closePaths(paths)
+		return nil
+	}
+	reply, ok := pkt.Payload.(PathChallenge)
+	if !ok || !answersChallenge(reply, challenge) {
+		errMsg := "Client did not prove it receives on the data paths it asked for"
+		log.Println(errMsg)
+		t.updateProgress(Progress{Type: ERROR, Message: errMsg, Percentage: 0})
+		closePaths(paths)
+		return nil
+	}
+	return startPaths(paths, groups, e, conn, t)
+}
+
+// startPaths gets the data paths ready, probing them if need be, and
+// starts the transfer. groups has the host the client gave each stream
+func startPaths(paths []dataPath, groups []string, e Encoder, conn net.Conn, t transfer) stateFn {
+	var conns []net.PacketConn
+	for _, path := range paths {
+		if !path.shared {
+			conns = append(conns, path.conn)
+		}
+	}
+	if len(conns) > 0 {
+		size := socketBufferSize(float64(t.config().TransferRate)/8/float64(len(paths)), t.(*serverTransfer).rtt)
+		if warning := tuneSocketBuffers(conns, size, false); warning != "" {
+			log.Println(warning)
+			t.updateProgress(Progress{Type: WARNING, Message: warning, Percentage: 1})
+		}
+	}
+	if !needsPathProbes(t.config()) {
+		t.(*serverTransfer).transport = UDP_TRANSPORT
+		return startTransfer(paths, e, conn, t)
+	}
+	//the client waits to hear back either way, and reports nothing
+	//received if the probes couldn't be sent, or there are no paths
+	//because the client never punched through. it only waits for
+	//stragglers if there were probes
+	sizes := probeSizes(t.config())
+	if len(sizes) > 0 {
+		for _, i := range pathStarts(groups[:len(paths)]) {
+			if err := sendMTUProbes(paths[i], sizes); err != nil {
+				log.Println("Error probing path MTU: " + err.Error())
+			}
+		}
+	}
+	outPkt := &Packet{Type: MTU_PROBE, Payload: len(sizes) * probeRepeats}
+	_, err := sendPacket(outPkt, conn, e)
+	if err != nil {
+		log.Println("Error sending MTU_PROBE: " + err.Error())
+		closePaths(paths)
+		return nil
+	}
+	acceptProbeResultStateWrapper := func(pkt1 *Packet, e1 Encoder, conn1 net.Conn, t1 transfer) stateFn {
+		return acceptProbeResultState(pkt1, e1, conn1, t1, paths)
+	}
+	return acceptProbeResultStateWrapper
+}
+
+func acceptProbeResultState(pkt *Packet, e Encoder, conn net.Conn, t transfer, paths []dataPath) stateFn {
+	if pkt.Type != MTU_PROBE {
+		log.Println("Expecting MTU_PROBE, did not receive it")
+		closePaths(paths)
+		return nil
+	}
+	largestProbe, ok := pkt.Payload.(int)
+	if !ok {
+		log.Println("Incorrect payload type")
+		closePaths(paths)
+		return nil
+	}
+	st := t.(*serverTransfer)
+	params := pathParams(largestProbe, e, st.c)
+	if params.Transport == TCP_TRANSPORT {
+		log.Println("Sending the data over the control connection")
+		closePaths(paths)
+		paths = nil
+	}
+	st.c.BlockSize = params.BlockSize
+	st.transport = params.Transport
+	//let the client know what to expect
+	outPkt := &Packet{Type: PATH_PARAMS, Payload: params}
+	_, err := sendPacket(outPkt, conn, e)
+	if err != nil {
+		log.Println("Error sending PATH_PARAMS: " + err.Error())
+		closePaths(paths)
+		return nil
+	}
+	return startTransfer(paths, e, conn, t)
+}
+
+func startTransfer(paths []dataPath, e Encoder, conn net.Conn, t transfer) stateFn {
+	t.(*serverTransfer).sendDone = make(chan bool)
+	go sendFile(paths, e, conn, t.(*serverTransfer))
 	t.updateProgress(Progress{Type: TRANSFERRING, Message: "Starting transfer", Percentage: 0})
 	return transferingState
 }
 
 func transferingState(pkt *Packet, e Encoder, conn net.Conn, t transfer) stateFn {
-
+	st := t.(*serverTransfer)
+	select {
+	case <-st.sendDone:
+		//the sender gave up, and has told the client why
+		return nil
+	default:
+	}
 	switch pkt.Type {
 	case RETRANSMIT:
 		rt, ok := pkt.Payload.(Retransmit)
@@ -169,19 +403,47 @@ func transferingState(pkt *Packet, e Encoder, conn net.Conn, t transfer) stateFn
 			log.Println("Incorrect payload type")
 			return nil
 		}
-		t.(*serverTransfer).controlCh <- controlMsg{msgType: RETRANSMIT, payload: rt}
-		return transferingState
+		//the ranges point into the read buffer, which the next packet
+		//is read into while the sender still has them
+		rt.Ranges = append([]byte(nil), rt.Ranges...)
+		if !st.control(controlMsg{msgType: RETRANSMIT, payload: rt}) {
+			return nil
+		}
 	case ERROR_RATE:
 		errorRate, ok := pkt.Payload.(float64)
 		if !ok {
 			log.Println("Incorrect payload type")
 			return nil
 		}
-		t.(*serverTransfer).controlCh <- controlMsg{msgType: ERROR_RATE, payload: errorRate}
+		if !st.control(controlMsg{msgType: ERROR_RATE, payload: errorRate}) {
+			return nil
+		}
+	case ERROR_RATES:
+		rates, ok := pkt.Payload.(PathErrorRates)
+		if !ok {
+			log.Println("Incorrect payload type")
+			return nil
+		}
+		if !st.control(controlMsg{msgType: ERROR_RATES, payload: rates}) {
+			return nil
+		}
+	case PING:
+		//echo the client's timestamp straight back
+		outPkt := &Packet{Type: PONG, Payload: pkt.Payload}
+		_, err := sendPacket(outPkt, conn, e)
+		if err != nil {
+			log.Println("Error sending PONG: " + err.Error())
+		}
+	case TRANSFER_ERROR:
+		reason, _ := pkt.Payload.(string)
+		errMsg := "Client ended the transfer: " + reason
+		log.Println(errMsg)
+		t.updateProgress(Progress{Type: ERROR, Message: errMsg, Percentage: 0})
+		st.control(controlMsg{msgType: TRANSFER_ERROR})
+		return nil
 	case DONE:
-		t.(*serverTransfer).controlCh <- controlMsg{msgType: DONE}
-		data, _ := e.Encode(pkt)
-		conn.Write(data)
+		st.control(controlMsg{msgType: DONE})
+		sendPacket(pkt, conn, e)
 		t.updateProgress(Progress{Type: TRANSFERRING, Message: "Transfer Complete", Percentage: 1})
 		return nil
 	}
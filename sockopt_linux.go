@@ -0,0 +1,83 @@
+//go:build linux
+
+package gonami
+
+import (
+	"errors"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const dontFragmentSupported = true
+
+// setDontFragment turns the DF bit on or off for what conn sends to
+// addr. while on, any path MTU the kernel has cached is ignored so
+// that probes really go out
+func setDontFragment(conn net.PacketConn, addr *net.UDPAddr, on bool) error {
+	raw, err := rawConn(conn)
+	if err != nil {
+		return err
+	}
+	ipv4Mode, ipv6Mode := unix.IP_PMTUDISC_WANT, unix.IPV6_PMTUDISC_WANT
+	if on {
+		ipv4Mode, ipv6Mode = unix.IP_PMTUDISC_PROBE, unix.IPV6_PMTUDISC_PROBE
+	}
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		if addr.IP.To4() == nil {
+			sockErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_MTU_DISCOVER, ipv6Mode)
+		} else {
+			sockErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_MTU_DISCOVER, ipv4Mode)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// rawConn gets at the socket underneath conn, when it is the system's
+func rawConn(conn net.PacketConn) (syscall.RawConn, error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil, errors.New("Not a system socket")
+	}
+	return sc.SyscallConn()
+}
+
+// reusePort lets several sockets share a local port, so the data
+// streams can all be sent from the same one
+func reusePort(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// socketBuffer reads back the size of conn's receive or send buffer.
+// the kernel doubles what is set, to allow for its own overhead
+func socketBuffer(conn net.PacketConn, receive bool) (int, error) {
+	raw, err := rawConn(conn)
+	if err != nil {
+		return 0, err
+	}
+	opt := unix.SO_SNDBUF
+	if receive {
+		opt = unix.SO_RCVBUF
+	}
+	var size int
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		size, sockErr = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, opt)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return size / 2, sockErr
+}
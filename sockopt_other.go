@@ -0,0 +1,24 @@
+//go:build !linux
+
+package gonami
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// the probes for the path MTU need it
+const dontFragmentSupported = false
+
+func setDontFragment(conn net.PacketConn, addr *net.UDPAddr, on bool) error {
+	return errors.New("Setting the DF bit is not supported on this platform")
+}
+
+func reusePort(network, address string, c syscall.RawConn) error {
+	return errors.New("Sharing a source port is not supported on this platform")
+}
+
+func socketBuffer(conn net.PacketConn, receive bool) (int, error) {
+	return 0, errors.New("Reading socket buffer sizes is not supported on this platform")
+}
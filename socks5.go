@@ -0,0 +1,313 @@
+package gonami
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	socksVersion      = 5
+	socksConnect      = 1
+	socksUDPAssociate = 3
+	socksIPv4         = 1
+	socksDomain       = 3
+	socksIPv6         = 4
+	socksNoAuth       = 0
+	socksUserPass     = 2
+	socksDefaultPort  = "1080"
+	//how long the proxy has to answer during its handshake
+	socksTimeout = 10 * time.Second
+)
+
+var socksReplies = []string{"succeeded", "general SOCKS server failure", "connection not allowed by ruleset",
+	"network unreachable", "host unreachable", "connection refused", "TTL expired", "command not supported",
+	"address type not supported"}
+
+// socksProxy is a SOCKS5 proxy (RFC 1928) the client reaches the server
+// through, over network. with remoteDNS, host names are left for the
+// proxy to resolve
+type socksProxy struct {
+	network   Network
+	addr      string
+	user      string
+	password  string
+	remoteDNS bool
+}
+
+// socksAssociation is a UDP relay the proxy keeps open for as long as
+// conn is
+type socksAssociation struct {
+	conn  net.Conn
+	relay *net.UDPAddr
+}
+
+func (a *socksAssociation) close() {
+	a.conn.Close()
+}
+
+// relayStreams gets a UDP relay from the proxy for each of n data
+// streams
+func relayStreams(ct *clientTransfer, n int) error {
+	for i := 0; i < n; i++ {
+		a, err := ct.proxy.associate()
+		if err != nil {
+			for _, a := range ct.associations {
+				a.close()
+			}
+			ct.associations = nil
+			return err
+		}
+		ct.associations = append(ct.associations, a)
+	}
+	return nil
+}
+
+// parseProxyURL takes socks5://[user:password@]host[:port], or socks5h
+// for the proxy to resolve the server's name
+func parseProxyURL(rawURL string, network Network) (*socksProxy, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "socks5" && u.Scheme != "socks5h" {
+		return nil, errors.New("Unsupported proxy scheme: " + u.Scheme)
+	}
+	p := &socksProxy{network: network, addr: u.Host, remoteDNS: u.Scheme == "socks5h"}
+	if u.Port() == "" {
+		p.addr = net.JoinHostPort(u.Hostname(), socksDefaultPort)
+	}
+	if u.User != nil {
+		p.user = u.User.Username()
+		p.password, _ = u.User.Password()
+	}
+	return p, nil
+}
+
+// dial opens a TCP connection to addr through the proxy
+func (p *socksProxy) dial(addr string) (net.Conn, error) {
+	host, port, err := splitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := p.connect()
+	if err != nil {
+		return nil, err
+	}
+	if _, _, err := p.request(conn, socksConnect, host, port); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// associate asks the proxy for a UDP relay
+func (p *socksProxy) associate() (*socksAssociation, error) {
+	conn, err := p.connect()
+	if err != nil {
+		return nil, err
+	}
+	//we don't know where our datagrams will come from, as seen by the proxy
+	host, port, err := p.request(conn, socksUDPAssociate, "0.0.0.0", 0)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsUnspecified() {
+		//the relay is on the proxy itself
+		ip = udpAddr(conn.RemoteAddr()).IP
+	}
+	return &socksAssociation{conn: conn, relay: &net.UDPAddr{IP: ip, Port: port}}, nil
+}
+
+// datagram wraps payload in the header the relay needs to forward it
+// on to host and port
+func (p *socksProxy) datagram(host string, port int, payload []byte) ([]byte, error) {
+	b, err := p.appendAddr([]byte{0, 0, 0}, host, port)
+	if err != nil {
+		return nil, err
+	}
+	return append(b, payload...), nil
+}
+
+// socksPayload strips the header off a datagram from the relay. they
+// can't be put back together if the relay fragmented them
+func socksPayload(b []byte) ([]byte, bool) {
+	if len(b) < 5 || b[2] != 0 {
+		return nil, false
+	}
+	var header int
+	switch b[3] {
+	case socksIPv4:
+		header = 4 + net.IPv4len + 2
+	case socksIPv6:
+		header = 4 + net.IPv6len + 2
+	case socksDomain:
+		header = 4 + 1 + int(b[4]) + 2
+	default:
+		return nil, false
+	}
+	if len(b) < header {
+		return nil, false
+	}
+	return b[header:], true
+}
+
+// connect opens a connection to the proxy, and authenticates with it
+func (p *socksProxy) connect() (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), socksTimeout)
+	defer cancel()
+	conn, err := p.network.DialContext(ctx, "tcp", p.addr)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(socksTimeout))
+	if err := p.authenticate(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (p *socksProxy) authenticate(conn net.Conn) error {
+	methods := []byte{socksNoAuth}
+	if p.user != "" {
+		methods = append(methods, socksUserPass)
+	}
+	if _, err := conn.Write(append([]byte{socksVersion, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	if reply[0] != socksVersion {
+		return errors.New("Not a SOCKS5 proxy")
+	}
+	switch {
+	case reply[1] == socksNoAuth:
+		return nil
+	case reply[1] == socksUserPass && p.user != "":
+		//RFC 1929
+		req := []byte{1, byte(len(p.user))}
+		req = append(req, p.user...)
+		req = append(req, byte(len(p.password)))
+		req = append(req, p.password...)
+		if _, err := conn.Write(req); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply[:]); err != nil {
+			return err
+		}
+		if reply[1] != 0 {
+			return errors.New("Proxy authentication failed")
+		}
+		return nil
+	}
+	return errors.New("Proxy accepts none of our authentication methods")
+}
+
+// request sends the proxy a command for host and port, and returns the
+// address it bound to carry it out
+func (p *socksProxy) request(conn net.Conn, cmd byte, host string, port int) (string, int, error) {
+	req, err := p.appendAddr([]byte{socksVersion, cmd, 0}, host, port)
+	if err != nil {
+		return "", 0, err
+	}
+	if _, err := conn.Write(req); err != nil {
+		return "", 0, err
+	}
+	var reply [4]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return "", 0, err
+	}
+	if reply[1] != 0 {
+		reason := "error " + strconv.Itoa(int(reply[1]))
+		if int(reply[1]) < len(socksReplies) {
+			reason = socksReplies[reply[1]]
+		}
+		return "", 0, errors.New("Proxy refused the request: " + reason)
+	}
+	var addr []byte
+	switch reply[3] {
+	case socksIPv4:
+		addr = make([]byte, net.IPv4len)
+	case socksIPv6:
+		addr = make([]byte, net.IPv6len)
+	case socksDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(conn, n[:]); err != nil {
+			return "", 0, err
+		}
+		addr = make([]byte, n[0])
+	default:
+		return "", 0, errors.New("Proxy replied with an unknown address type")
+	}
+	var portBytes [2]byte
+	if _, err := io.ReadFull(conn, addr); err != nil {
+		return "", 0, err
+	}
+	if _, err := io.ReadFull(conn, portBytes[:]); err != nil {
+		return "", 0, err
+	}
+	bound := string(addr)
+	if reply[3] != socksDomain {
+		bound = net.IP(addr).String()
+	}
+	return bound, int(binary.BigEndian.Uint16(portBytes[:])), nil
+}
+
+// appendAddr encodes host and port the way the proxy expects them.
+// names are resolved here unless the proxy is to do it
+func (p *socksProxy) appendAddr(b []byte, host string, port int) ([]byte, error) {
+	ip := net.ParseIP(host)
+	if ip == nil && p.remoteDNS {
+		if len(host) > 255 {
+			return nil, errors.New("Host name too long for the proxy: " + host)
+		}
+		b = append(b, socksDomain, byte(len(host)))
+		b = append(b, host...)
+		return binary.BigEndian.AppendUint16(b, uint16(port)), nil
+	}
+	if ip == nil {
+		addr, err := net.ResolveIPAddr("ip", host)
+		if err != nil {
+			return nil, err
+		}
+		ip = addr.IP
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		b = append(b, socksIPv4)
+		b = append(b, ip4...)
+	} else {
+		b = append(b, socksIPv6)
+		b = append(b, ip.To16()...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(port)), nil
+}
+
+// sameUDPAddr is whether addr is the IP and port of want
+func sameUDPAddr(addr net.Addr, want *net.UDPAddr) bool {
+	got := udpAddr(addr)
+	return got.Port == want.Port && got.IP.Equal(want.IP)
+}
+
+func splitHostPort(addr string) (string, int, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return "", 0, errors.New("Invalid port: " + portStr)
+	}
+	return host, port, nil
+}
@@ -0,0 +1,314 @@
+package gonami
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+type socksRequest struct {
+	methods []byte
+	cmd     byte
+	atyp    byte
+	host    string
+	port    int
+}
+
+// fakeSocks is an in-process SOCKS5 proxy. it records what each
+// connection asked for, answers with reply and bound, and echoes back
+// whatever comes over a CONNECT it accepted
+type fakeSocks struct {
+	l        net.Listener
+	user     string //credentials it insists on, when set
+	password string
+	reply    byte
+	bound    []byte //address type, address and port of the replies
+	requests chan socksRequest
+}
+
+func startFakeSocks(t *testing.T) *fakeSocks {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeSocks{l: l, bound: []byte{socksIPv4, 0, 0, 0, 0, 0, 0}, requests: make(chan socksRequest, 10)}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.handle(c)
+		}
+	}()
+	t.Cleanup(func() { l.Close() })
+	return s
+}
+
+func (s *fakeSocks) proxy(scheme string) *socksProxy {
+	p, _ := parseProxyURL(scheme+"://"+s.l.Addr().String(), systemNetwork{})
+	return p
+}
+
+func (s *fakeSocks) handle(c net.Conn) {
+	defer c.Close()
+	var req socksRequest
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(c, header); err != nil || header[0] != socksVersion {
+		return
+	}
+	req.methods = make([]byte, header[1])
+	io.ReadFull(c, req.methods)
+	method := byte(0xff)
+	for _, m := range req.methods {
+		if (m == socksNoAuth && s.user == "") || (m == socksUserPass && s.user != "") {
+			method = m
+		}
+	}
+	c.Write([]byte{socksVersion, method})
+	if method == 0xff {
+		return
+	}
+	if method == socksUserPass {
+		user, password := readSocksString(c, 1), readSocksString(c, 0)
+		if user != s.user || password != s.password {
+			c.Write([]byte{1, 1})
+			return
+		}
+		c.Write([]byte{1, 0})
+	}
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(c, head); err != nil {
+		return
+	}
+	req.cmd, req.atyp = head[1], head[3]
+	switch req.atyp {
+	case socksIPv4, socksIPv6:
+		ip := make([]byte, map[byte]int{socksIPv4: net.IPv4len, socksIPv6: net.IPv6len}[req.atyp])
+		io.ReadFull(c, ip)
+		req.host = net.IP(ip).String()
+	case socksDomain:
+		req.host = readSocksString(c, 0)
+	}
+	port := make([]byte, 2)
+	io.ReadFull(c, port)
+	req.port = int(binary.BigEndian.Uint16(port))
+	s.requests <- req
+	c.Write(append([]byte{socksVersion, s.reply, 0}, s.bound...))
+	if s.reply == 0 && req.cmd == socksConnect {
+		io.Copy(c, c)
+	}
+}
+
+// readSocksString reads a length prefixed string, after skipping skip
+// bytes
+func readSocksString(r io.Reader, skip int) string {
+	b := make([]byte, skip+1)
+	io.ReadFull(r, b)
+	s := make([]byte, b[skip])
+	io.ReadFull(r, s)
+	return string(s)
+}
+
+func TestSocksConnect(t *testing.T) {
+	for _, test := range []struct {
+		scheme   string
+		user     string
+		addr     string
+		atyp     byte
+		host     string
+		port     int
+		withAuth bool
+	}{
+		{"socks5", "", "127.0.0.1:80", socksIPv4, "127.0.0.1", 80, false},
+		{"socks5", "", "[::1]:443", socksIPv6, "::1", 443, false},
+		{"socks5h", "", "files.example:8080", socksDomain, "files.example", 8080, false},
+		{"socks5", "user:secret@", "127.0.0.1:9000", socksIPv4, "127.0.0.1", 9000, true},
+	} {
+		s := startFakeSocks(t)
+		if test.withAuth {
+			s.user, s.password = "user", "secret"
+		}
+		p, err := parseProxyURL(test.scheme+"://"+test.user+s.l.Addr().String(), systemNetwork{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := p.dial(test.addr)
+		if err != nil {
+			t.Errorf("%s: %v", test.addr, err)
+			continue
+		}
+		req := <-s.requests
+		if req.cmd != socksConnect || req.atyp != test.atyp || req.host != test.host || req.port != test.port {
+			t.Errorf("%s: proxy got %+v", test.addr, req)
+		}
+		if test.withAuth != bytes.Contains(req.methods, []byte{socksUserPass}) {
+			t.Errorf("%s: offered methods %v", test.addr, req.methods)
+		}
+		//the connection carries on through the proxy once it is set up
+		conn.Write([]byte("ping"))
+		echo := make([]byte, 4)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := io.ReadFull(conn, echo); err != nil || string(echo) != "ping" {
+			t.Errorf("%s: got %q, %v through the proxy", test.addr, echo, err)
+		}
+		conn.Close()
+	}
+}
+
+func TestSocksRefused(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		user     string
+		required string
+		reply    byte
+		want     string
+	}{
+		{"refused", "", "", 5, "connection refused"},
+		{"unknown reply", "", "", 42, "error 42"},
+		{"wrong password", "user:wrong@", "user", 0, "authentication failed"},
+		{"needs a password", "", "user", 0, "none of our authentication methods"},
+	} {
+		s := startFakeSocks(t)
+		s.user, s.password, s.reply = test.required, "secret", test.reply
+		p, _ := parseProxyURL("socks5://"+test.user+s.l.Addr().String(), systemNetwork{})
+		_, err := p.dial("127.0.0.1:80")
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: got %v, want %q", test.name, err, test.want)
+		}
+	}
+}
+
+func TestSocksAssociate(t *testing.T) {
+	s := startFakeSocks(t)
+	//a relay on the proxy itself is given as the unspecified address
+	s.bound = []byte{socksIPv4, 0, 0, 0, 0, 0x13, 0x88}
+	a, err := s.proxy("socks5").associate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.close()
+	if req := <-s.requests; req.cmd != socksUDPAssociate {
+		t.Errorf("proxy got %+v", req)
+	}
+	if a.relay.String() != "127.0.0.1:5000" {
+		t.Errorf("relay at %v, want the proxy's address", a.relay)
+	}
+
+	s.bound = []byte{socksIPv4, 10, 1, 2, 3, 0, 99}
+	a, err = s.proxy("socks5").associate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.close()
+	<-s.requests
+	if a.relay.String() != "10.1.2.3:99" {
+		t.Errorf("relay at %v, want 10.1.2.3:99", a.relay)
+	}
+}
+
+func TestSocksDatagramHeader(t *testing.T) {
+	payload := []byte("block")
+	for _, test := range []struct {
+		scheme string
+		host   string
+		header []byte
+	}{
+		{"socks5", "10.0.0.1", []byte{0, 0, 0, socksIPv4, 10, 0, 0, 1, 0x13, 0x88}},
+		{"socks5", "::1", append(append([]byte{0, 0, 0, socksIPv6}, net.IPv6loopback...), 0x13, 0x88)},
+		{"socks5h", "files.example", append([]byte{0, 0, 0, socksDomain, 13}, "files.example\x13\x88"...)},
+	} {
+		p := &socksProxy{remoteDNS: test.scheme == "socks5h"}
+		b, err := p.datagram(test.host, 5000, payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := append(append([]byte{}, test.header...), payload...); !bytes.Equal(b, want) {
+			t.Errorf("%s: got %x, want %x", test.host, b, want)
+		}
+		if got, ok := socksPayload(b); !ok || !bytes.Equal(got, payload) {
+			t.Errorf("%s: unwrapped %q, %v", test.host, got, ok)
+		}
+	}
+
+	wrapped, _ := (&socksProxy{}).datagram("10.0.0.1", 5000, payload)
+	fragment := append([]byte{}, wrapped...)
+	fragment[2] = 1
+	for name, b := range map[string][]byte{
+		"empty":            nil,
+		"fragment":         fragment,
+		"cut short":        wrapped[:8],
+		"unknown type":     {0, 0, 0, 9, 1, 2, 3, 4, 5, 6},
+		"domain past end":  {0, 0, 0, socksDomain, 200, 'a', 0, 1},
+		"not socks at all": []byte("\x00\x01\x02"),
+	} {
+		if got, ok := socksPayload(b); ok {
+			t.Errorf("%s: unwrapped %q", name, got)
+		}
+	}
+}
+
+// TestSocksUnexpectedSource checks only the relay's own wrapped
+// datagrams come out of the pipeline, in the order they arrived
+func TestSocksUnexpectedSource(t *testing.T) {
+	e := BsonEncoder{}
+	listen := func() *net.UDPConn {
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+	rx, relay, stranger := listen(), listen(), listen()
+	c := NewConfig()
+	c.ReceiveWorkers = 4
+	pool := newBufferPool(c.BlockSize, c.ReceiveQueueLength)
+	done := make(chan bool)
+	defer close(done)
+	blocks := startStreamPipeline(e, rx, relay.LocalAddr().(*net.UDPAddr), c, pool, done)
+
+	p := &socksProxy{}
+	wrap := func(number int) []byte {
+		b, _ := appendBlock(e, nil, &Block{Number: number, Data: []byte(strconv.Itoa(number)), Type: ORIGINAL})
+		wrapped, _ := p.datagram("127.0.0.1", 5000, b)
+		return wrapped
+	}
+	const numBlocks = 20
+	for i := 0; i < numBlocks; i++ {
+		relay.WriteTo(wrap(i), rx.LocalAddr())
+		switch i % 4 {
+		case 0:
+			//wrapped, but from someone else
+			stranger.WriteTo(wrap(1000+i), rx.LocalAddr())
+		case 1:
+			//from the relay, without its header
+			b, _ := appendBlock(e, nil, &Block{Number: 2000 + i, Type: ORIGINAL})
+			relay.WriteTo(b, rx.LocalAddr())
+		case 2:
+			//wrapped, but not a block
+			garbage, _ := p.datagram("127.0.0.1", 5000, []byte("garbage"))
+			relay.WriteTo(garbage, rx.LocalAddr())
+		}
+	}
+	for i := 0; i < numBlocks; i++ {
+		select {
+		case d := <-blocks:
+			if d.err != nil || d.block.Number != i {
+				t.Fatalf("got block %d, %v, want block %d", d.block.Number, d.err, i)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("block %d never came out", i)
+		}
+	}
+	select {
+	case d := <-blocks:
+		t.Errorf("got an extra block %d", d.block.Number)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
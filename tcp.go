@@ -0,0 +1,125 @@
+package gonami
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+// the block size used over TCP, unless the client set its own by
+// turning off PathMTUDiscovery. there are no datagrams to fit into
+const tcpBlockSize = 64 << 10
+
+// pathParams settles how the data is sent, from the largest MTU probe
+// the client received. when nothing got through, UDP is given up on
+func pathParams(largestProbe int, e Encoder, c Config) PathParams {
+	if c.Transport == TCP_TRANSPORT || largestProbe <= 0 && c.Transport == AUTO_TRANSPORT {
+		blockSize := c.BlockSize
+		if c.PathMTUDiscovery {
+			blockSize = tcpBlockSize
+		}
+		return PathParams{BlockSize: blockSize, Transport: TCP_TRANSPORT}
+	}
+	blockSize := c.BlockSize
+	if c.PathMTUDiscovery && dontFragmentSupported {
+		blockSize = discoveredBlockSize(largestProbe, e, c)
+	}
+	return PathParams{BlockSize: blockSize, Transport: UDP_TRANSPORT}
+}
+
+// needsPathProbes is whether the server probes the data paths during
+// the handshake, to size the blocks or to settle on TCP
+func needsPathProbes(c Config) bool {
+	return c.PathMTUDiscovery || c.Transport != UDP_TRANSPORT
+}
+
+// packetWriter queues up encoded packets for a packetSender, and
+// sends them on together
+type packetWriter interface {
+	full() bool
+	buf() []byte
+	add(b []byte)
+	flush() error
+}
+
+// frameWriter queues up packets for a TCP connection, framed the same
+// as by sendPacket, and writes them out in a single write. net.Conn
+// writes don't interleave, so other packets can still be sent on the
+// connection alongside
+type frameWriter struct {
+	conn    net.Conn
+	max     int
+	n       int
+	frames  []byte
+	scratch []byte
+}
+
+func newFrameWriter(conn net.Conn, batchSize int) *frameWriter {
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	return &frameWriter{conn: conn, max: batchSize}
+}
+
+func (w *frameWriter) full() bool {
+	return w.n == w.max
+}
+
+func (w *frameWriter) buf() []byte {
+	return w.scratch[:0]
+}
+
+func (w *frameWriter) add(b []byte) {
+	w.frames = binary.BigEndian.AppendUint32(w.frames, uint32(len(b)))
+	w.frames = append(w.frames, b...)
+	w.scratch = b
+	w.n++
+}
+
+func (w *frameWriter) flush() error {
+	defer func() {
+		w.frames = w.frames[:0]
+		w.n = 0
+	}()
+	_, err := writeControl(w.conn, DATA, w.frames)
+	return err
+}
+
+// tcpReceiver hands the blocks that come in on the control connection
+// over to the download
+type tcpReceiver struct {
+	blocks       chan decodedBlock
+	done         chan bool
+	pool         *bufferPool
+	decompressor *blockDecompressor
+}
+
+func newTCPReceiver(c Config) *tcpReceiver {
+	r := &tcpReceiver{blocks: make(chan decodedBlock, c.BatchSize), done: make(chan bool),
+		pool: newBufferPool(c.BlockSize, 4*c.BatchSize)}
+	if c.Compression != NO_COMPRESSION {
+		r.decompressor = newBlockDecompressor()
+	}
+	return r
+}
+
+// receive copies block out of the control connection's buffer, and
+// passes it on unless the download has already finished
+func (r *tcpReceiver) receive(block Block) {
+	select {
+	case r.blocks <- copyBlock(block, r.pool, r.decompressor):
+	case <-r.done:
+	}
+}
+
+// stop is called by the download once it no longer takes blocks
+func (r *tcpReceiver) stop() {
+	close(r.done)
+}
+
+// close is called by the control connection's reader, once it no
+// longer receives blocks
+func (r *tcpReceiver) close() {
+	if r.decompressor != nil {
+		r.decompressor.close()
+	}
+}
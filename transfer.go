@@ -1,5 +1,7 @@
 package gonami
 
+import "time"
+
 type ProgressType int
 
 const (
@@ -7,46 +9,103 @@ const (
 	TRANSFERRING
 	ERROR
 	TRANSFER_DONE
+	WARNING //something that may hold the transfer back, it carries on regardless
+)
+
+// TransportType is how the blocks get to the client
+type TransportType int
+
+const (
+	AUTO_TRANSPORT TransportType = iota //UDP, falling back to TCP when none of it gets through
+	UDP_TRANSPORT
+	TCP_TRANSPORT //over the control connection
 )
 
 type Progress struct {
-	Message    string
-	Percentage float64
-	Type       ProgressType
+	Message        string
+	Percentage     float64
+	Type           ProgressType
+	RTT            time.Duration //smoothed round trip time of the control channel
+	Throughput     float64       //bytes of the file received per second
+	WireThroughput float64       //bytes of block data received per second, after compression
+	Transport      TransportType //what the data is sent over, AUTO_TRANSPORT until that is settled
+	Local          bool          //the client copied the server's file itself, see Client.ServerDirectory
 }
 
 const (
-	defaultTransferRate    = 7500000 //bits per second
-	defaultBlockSize       = 1024    //in bytes
-	defaultErrorRate       = 7500    //threshhold error rate (% x 1000)
-	defaultSlowerNum       = 25      //numerator in the slowdown factor
-	defaultSlowerDen       = 24      //denominator in the slowdown factor
-	defaultFasterNum       = 5       //numerator in the speedup factor
-	defaultFasterDen       = 6       //denominator in the speedup factor
-	defaultMaxMissedLength = 4096
+	defaultTransferRate     = 7500000 //bits per second
+	defaultBlockSize        = 1024    //in bytes
+	defaultErrorRate        = 7500    //threshhold error rate (% x 1000)
+	defaultSlowerNum        = 25      //numerator in the slowdown factor
+	defaultSlowerDen        = 24      //denominator in the slowdown factor
+	defaultFasterNum        = 5       //numerator in the speedup factor
+	defaultFasterDen        = 6       //denominator in the speedup factor
+	defaultMaxMissedLength  = 4096
+	defaultBatchSize        = 32 //datagrams per send/receive syscall
+	defaultWriteExtentSize  = 1 << 20
+	defaultWriteBufferSize  = 16 << 20
+	defaultWriteFlushTime   = 1000 //in milliseconds
+	defaultReceiveWorkers   = 2
+	defaultReceiveQueue     = 1024 //datagrams queued between receive stages
+	defaultProgressInterval = 100  //in milliseconds
+	defaultFECParityShards  = 2
+	defaultFECMaxParity     = 8
+	defaultDataStreams      = 1
 )
 
 type Config struct {
-	ListenPort      int
-	TransferRate    int //bits per second
-	BlockSize       int //in bytes
-	ErrorRate       int //threshhold error rate (% x 1000)
-	SlowerNum       int //numerator in the slowdown factor
-	SlowerDen       int //denominator in the slowdown factor
-	FasterNum       int //numerator in the speedup factor
-	FasterDen       int //denominator in the speedup factor
-	MaxMissedLength int //max number of missed blocks before requesting retransmit
+	ListenPort         int           //first port to receive the data on, any free port when 0
+	ListenPortMax      int           //last port to receive the data on, ListenPort when 0
+	TransferRate       int           //bits per second
+	BlockSize          int           //in bytes, used as is unless PathMTUDiscovery finds a size
+	ErrorRate          int           //threshhold error rate (% x 1000)
+	SlowerNum          int           //numerator in the slowdown factor
+	SlowerDen          int           //denominator in the slowdown factor
+	FasterNum          int           //numerator in the speedup factor
+	FasterDen          int           //denominator in the speedup factor
+	MaxMissedLength    int           //max number of missed block ranges, not blocks, in a retransmit request before requesting a restart
+	BatchSize          int           //max number of datagrams sent or received per syscall
+	WriteExtentSize    int           //size in bytes of the contiguous extents received blocks are gathered into
+	WriteBufferSize    int           //max bytes of received data held in memory before being written
+	WriteFlushTime     int           //milliseconds a partially filled extent can sit idle before being written
+	ReceiveWorkers     int           //number of goroutines decoding received datagrams
+	ReceiveQueueLength int           //max number of datagrams queued between the stages of the receive path
+	ProgressInterval   int           //min milliseconds between TRANSFERRING progress updates
+	FECDataShards      int           //blocks per forward error correction group, 0 disables FEC
+	FECParityShards    int           //min parity blocks sent per group
+	FECMaxParityShards int           //max parity blocks per group as the loss rate goes up
+	Compression        string        //algorithm to compress blocks with if the server supports it, eg ZSTD
+	PathMTUDiscovery   bool          //size blocks to fill the largest datagrams that get through unfragmented, off by default so BlockSize is used as is
+	DataStreams        int           //number of UDP sockets the data is striped across, per path
+	Multipath          bool          //receive over every local interface, with the load spread by how each path copes
+	Passive            bool          //have the server listen for data connections, for clients behind NAT
+	Transport          TransportType //AUTO_TRANSPORT, or UDP_TRANSPORT or TCP_TRANSPORT to never or always send the data over TCP
+	ListenAddr         string        //local address to receive the data on, every interface when empty. overrides Multipath
+	DataDSCP           int           //DSCP the server marks the data with, 0 leaves it unmarked
+	ControlDSCP        int           //DSCP the client marks the control connection with, 0 leaves it unmarked
+	OfferIdentity      bool          //have the server say which file it has, set by a client with a ServerDirectory
 }
 
 func NewConfig() Config {
 	return Config{TransferRate: defaultTransferRate,
-		BlockSize:       defaultBlockSize,
-		ErrorRate:       defaultErrorRate,
-		SlowerNum:       defaultSlowerNum,
-		SlowerDen:       defaultSlowerDen,
-		FasterNum:       defaultFasterNum,
-		FasterDen:       defaultFasterDen,
-		MaxMissedLength: defaultMaxMissedLength}
+		BlockSize:          defaultBlockSize,
+		ErrorRate:          defaultErrorRate,
+		SlowerNum:          defaultSlowerNum,
+		SlowerDen:          defaultSlowerDen,
+		FasterNum:          defaultFasterNum,
+		FasterDen:          defaultFasterDen,
+		MaxMissedLength:    defaultMaxMissedLength,
+		BatchSize:          defaultBatchSize,
+		WriteExtentSize:    defaultWriteExtentSize,
+		WriteBufferSize:    defaultWriteBufferSize,
+		WriteFlushTime:     defaultWriteFlushTime,
+		ReceiveWorkers:     defaultReceiveWorkers,
+		ReceiveQueueLength: defaultReceiveQueue,
+		ProgressInterval:   defaultProgressInterval,
+		FECParityShards:    defaultFECParityShards,
+		FECMaxParityShards: defaultFECMaxParity,
+		PathMTUDiscovery:   false,
+		DataStreams:        defaultDataStreams}
 
 }
 
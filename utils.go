@@ -1,14 +1,20 @@
 package gonami
 
 import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
 	"log"
 	"net"
+	"net/netip"
 )
 
 const (
-	secret     = "kitten"
-	revision   = 20061025
-	readBuffer = 100000
+	secret        = "kitten"
+	revision      = 20061034
+	readBuffer    = 100000
+	maxPacketSize = 1 << 26
 )
 
 func xORSecret(b []byte, secret string) []byte {
@@ -26,6 +32,10 @@ func xORSecret(b []byte, secret string) []byte {
 	return r
 }
 
+// sendPacket writes pkt to the control connection, prefixed with its
+// length so that the reader can split the stream back into packets.
+// it goes out in a single write, so it is safe to call concurrently.
+// over QUIC, it goes out on the stream for its type
 func sendPacket(pkt *Packet, conn net.Conn, encoder Encoder) (int, error) {
 
 	b, err := encoder.Encode(pkt)
@@ -33,7 +43,10 @@ func sendPacket(pkt *Packet, conn net.Conn, encoder Encoder) (int, error) {
 	if err != nil {
 		return -1, err
 	}
-	numBytes, err := conn.Write(b)
+	framed := make([]byte, 4, 4+len(b))
+	binary.BigEndian.PutUint32(framed, uint32(len(b)))
+	framed = append(framed, b...)
+	numBytes, err := writeControl(conn, pkt.Type, framed)
 
 	if err != nil {
 		return -1, err
@@ -41,18 +54,25 @@ func sendPacket(pkt *Packet, conn net.Conn, encoder Encoder) (int, error) {
 	return numBytes, nil
 }
 
+// controlBuffers are shared by the control connections of all transfers
+var controlBuffers = newBufferPool(readBuffer, 16)
+
 func readPackets(conn net.Conn, e Encoder, t transfer, initialState stateFn) {
 	inTransmission := true
 	stateMachine := newStateMachine(initialState)
+	//packets are handled before the next read, so one buffer does. a
+	//state that hands on a payload pointing into it has to copy it
+	data := controlBuffers.get()
+	defer controlBuffers.put(data)
+	r := bufio.NewReader(conn)
 	for inTransmission {
-		data := make([]byte, readBuffer)
-		// Read the incoming connection into the buffer.
-		numBytes, err := conn.Read(data)
+		// Read the next packet off the connection into the buffer.
+		frame, err := readFrame(r, data)
 		if err != nil {
 			log.Println("Error reading bytes: " + err.Error())
 			return
 		}
-		packet, err := e.Decode(data, numBytes)
+		packet, err := e.Decode(frame, len(frame))
 		if err != nil {
 			log.Println("Error decoding bytes: " + err.Error())
 			return
@@ -60,3 +80,69 @@ func readPackets(conn net.Conn, e Encoder, t transfer, initialState stateFn) {
 		inTransmission = stateMachine.transition(packet, e, conn, t)
 	}
 }
+
+// readFrame reads one length prefixed packet, see sendPacket. buf is
+// used when the packet fits
+func readFrame(r io.Reader, buf []byte) ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	n := int(binary.BigEndian.Uint32(header[:]))
+	if n > maxPacketSize {
+		return nil, errors.New("packet too large")
+	}
+	if n > len(buf) {
+		buf = make([]byte, n)
+	}
+	if _, err := io.ReadFull(r, buf[:n]); err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// abortTransfer reports errMsg, and tells the other end the transfer
+// can't go on
+func abortTransfer(errMsg string, conn net.Conn, e Encoder, t transfer) {
+	log.Println(errMsg)
+	t.updateProgress(Progress{Type: ERROR, Message: errMsg, Percentage: 0})
+	pkt := Packet{Type: TRANSFER_ERROR, Payload: errMsg}
+	if _, err := sendPacket(&pkt, conn, e); err != nil {
+		log.Println("Error sending TRANSFER_ERROR: " + err.Error())
+	}
+}
+
+// udpAddr gives the IP, zone and port of an address at either end of
+// a control connection, which is a UDP one over QUIC. addresses from
+// a Network other than the system's are parsed from their host:port
+func udpAddr(addr net.Addr) *net.UDPAddr {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return &net.UDPAddr{IP: a.IP, Port: a.Port, Zone: a.Zone}
+	case *net.UDPAddr:
+		return a
+	}
+	if addr == nil {
+		return &net.UDPAddr{}
+	}
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return &net.UDPAddr{}
+	}
+	return net.UDPAddrFromAddrPort(ap)
+}
+
+// bindAddr resolves a local address to bind a UDP socket to, where
+// empty means leaving it to the system
+func bindAddr(host string) (*net.UDPAddr, error) {
+	if host == "" {
+		return nil, nil
+	}
+	return net.ResolveUDPAddr("udp", net.JoinHostPort(host, "0"))
+}
+
+func closeConns(conns []net.PacketConn) {
+	for _, conn := range conns {
+		conn.Close()
+	}
+}